@@ -1,21 +1,64 @@
 package applications
 
 import (
+	"context"
+	"fmt"
+	"gbf-proxy/lib/admission"
 	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/cachekey"
+	"gbf-proxy/lib/cachepolicy"
+	"gbf-proxy/lib/compression"
+	"gbf-proxy/lib/config"
+	"gbf-proxy/lib/hostrules"
 	"gbf-proxy/lib/logger"
 	"gbf-proxy/lib/marshaler"
+	"gbf-proxy/lib/metrics"
+	"gbf-proxy/lib/mitm"
 	"gbf-proxy/services"
 	"gbf-proxy/services/handlers"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis"
+)
+
+const (
+	CACHE_BACKEND_MEMCACHED = "memcached"
+	CACHE_BACKEND_REDIS     = "redis"
+	CACHE_BACKEND_FILE      = "file"
 )
 
 type MonolithicApp struct {
-	Version       string
-	WebAddr       string
-	WebHost       string
-	MemcachedAddr string
-	ListenerAddr  string
+	Version          string
+	ConfigPath       string
+	WebAddr          string
+	WebHost          string
+	MemcachedAddrs   []string
+	MemcachedJournal string
+	MemcachedTimeout time.Duration
+	MemcachedMaxIdle int
+	BreakerFailures  int
+	BreakerTimeout   time.Duration
+	RedisAddr        string
+	ListenerAddr     string
+	CacheBackend     string
+	CacheDir         string
+	CacheSize        int64
+	CacheCompression string
+	Admission        string
+	AdmissionWindow  time.Duration
+	MemoryCache      int64
+	AdminAddr        string
+	AdminToken       string
+	MitmCACert       string
+	MitmCAKey        string
+
+	CoalesceTimeout time.Duration
+	NegativeTTL     time.Duration
 }
 
 var _ Application = (*MonolithicApp)(nil)
@@ -23,17 +66,201 @@ var _ Application = (*MonolithicApp)(nil)
 var log = logger.DefaultLogger
 
 func (a MonolithicApp) Start() error {
-	memcachedClient := memcache.New(a.MemcachedAddr)
-	msgpackMarshaler := marshaler.NewMsgpackMarshaler()
-	cacheClient := cache.NewMemcachedClient(memcachedClient, msgpackMarshaler)
-
+	if a.AdminAddr != "" && a.AdminToken == "" {
+		return fmt.Errorf("An admin token is required to serve the admin endpoints")
+	}
+	c, hostRules, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
 	proxyHandler := handlers.NewProxyHandler()
-	cacheHandler := handlers.NewCacheHandler(proxyHandler, cacheClient)
+	cacheHandler, err := a.createCacheHandler(proxyHandler, c, hostRules)
+	if err != nil {
+		return err
+	}
+	defer cacheHandler.Close()
+	authority, err := a.loadAuthority()
+	if err != nil {
+		return err
+	}
 	webHandler := handlers.NewWebHandler(a.Version, a.WebHost, a.WebAddr)
-	gatewayHandler := handlers.NewGatewayHandler(a.Version, cacheHandler, webHandler)
+	gatewayHandler := handlers.NewGatewayHandler(a.Version, cacheHandler, webHandler, hostRules, authority)
 	connectionHandler := handlers.NewConnectionHandler(gatewayHandler)
 	service := services.NewListenerService("Proxy", connectionHandler)
 
 	log.Infof("Starting up Granblue Proxy %s", a.Version)
+	if a.AdminAddr != "" {
+		go a.serveAdmin(cacheHandler)
+	}
+	if a.ConfigPath != "" {
+		go a.reloadOnHangup(cacheHandler, hostRules)
+	}
 	return service.Serve(a.ListenerAddr)
 }
+
+func (a MonolithicApp) ExportCache(w io.Writer) (int, error) {
+	c, hostRules, err := a.loadConfig()
+	if err != nil {
+		return 0, err
+	}
+	cacheHandler, err := a.createCacheHandler(handlers.NewProxyHandler(), c, hostRules)
+	if err != nil {
+		return 0, err
+	}
+	defer cacheHandler.Close()
+	return cacheHandler.Export(context.Background(), w)
+}
+
+func (a MonolithicApp) ImportCache(r io.Reader) (int, error) {
+	c, hostRules, err := a.loadConfig()
+	if err != nil {
+		return 0, err
+	}
+	cacheHandler, err := a.createCacheHandler(handlers.NewProxyHandler(), c, hostRules)
+	if err != nil {
+		return 0, err
+	}
+	defer cacheHandler.Close()
+	return cacheHandler.Import(context.Background(), r)
+}
+
+func (a MonolithicApp) serveAdmin(cacheHandler *handlers.CacheHandler) {
+	adminHandler := handlers.NewAdminHandler(a.Version, a.AdminToken, cacheHandler)
+	connectionHandler := handlers.NewConnectionHandler(adminHandler)
+	service := services.NewListenerService("Admin", connectionHandler)
+	if err := service.Serve(a.AdminAddr); err != nil {
+		log.Error(err)
+	}
+}
+
+// reloadOnHangup applies the cache policy and host rules from the
+// configuration file again whenever the process receives SIGHUP.
+func (a MonolithicApp) reloadOnHangup(cacheHandler *handlers.CacheHandler, hostRules *hostrules.Engine) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		c, err := config.Load(a.ConfigPath)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		policy, err := cachepolicy.NewPolicy(c.CachePolicy)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := hostRules.Reload(c.HostRules); err != nil {
+			log.Error(err)
+			continue
+		}
+		cacheHandler.SetPolicy(policy)
+		log.Infof("Reloaded cache policy and host rules from %s", a.ConfigPath)
+	}
+}
+
+// loadAuthority loads the CA that TLS interception is enabled with, if it
+// has been configured.
+func (a MonolithicApp) loadAuthority() (*mitm.Authority, error) {
+	if a.MitmCACert == "" && a.MitmCAKey == "" {
+		return nil, nil
+	}
+	if a.MitmCACert == "" || a.MitmCAKey == "" {
+		return nil, fmt.Errorf("Both a CA certificate and a CA key are required for TLS interception")
+	}
+	authority, err := mitm.LoadAuthority(a.MitmCACert, a.MitmCAKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Intercepting TLS connections to asset hosts with CA %s", a.MitmCACert)
+	return authority, nil
+}
+
+func (a MonolithicApp) loadConfig() (*config.Config, *hostrules.Engine, error) {
+	c, err := config.Load(a.ConfigPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostRules, err := hostrules.NewEngine(c.HostRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, hostRules, nil
+}
+
+func (a MonolithicApp) createCacheHandler(rh handlers.RequestHandler, c *config.Config, hostRules *hostrules.Engine) (*handlers.CacheHandler, error) {
+	keyNormalizer, err := cachekey.NewNormalizer(c.CacheKeys)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := cachepolicy.NewPolicy(c.CachePolicy)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := compression.Get(a.CacheCompression)
+	if err != nil {
+		return nil, err
+	}
+	admissionFilter, err := admission.New(a.Admission, a.AdmissionWindow)
+	if err != nil {
+		return nil, err
+	}
+	cacheClient, err := a.createCacheClient()
+	if err != nil {
+		return nil, err
+	}
+	cache.RegisterStats(metrics.DefaultRegistry, "cache", cacheClient)
+	return handlers.NewCacheHandler(rh, cacheClient, handlers.CacheOptions{
+		CoalesceTimeout: a.CoalesceTimeout,
+		KeyNormalizer:   keyNormalizer,
+		Compression:     codec,
+		NegativeTTL:     a.NegativeTTL,
+		Policy:          policy,
+		Admission:       admissionFilter,
+		HostRules:       hostRules,
+	}), nil
+}
+
+func (a MonolithicApp) createCacheClient() (cache.Client, error) {
+	backend, err := a.createCacheBackend()
+	if err != nil {
+		return nil, err
+	}
+	backend = cache.NewBreakerClient(backend, a.BreakerFailures, a.BreakerTimeout)
+	if a.MemoryCache <= 0 {
+		return backend, nil
+	}
+	log.Infof("Using in-memory cache of %d bytes", a.MemoryCache)
+	return cache.NewTieredClient(backend, a.MemoryCache), nil
+}
+
+func (a MonolithicApp) createCacheBackend() (cache.Client, error) {
+	entryMarshaler, err := marshaler.NewEnvelopeMarshaler(marshaler.MARSHALER_MSGPACK, handlers.CACHE_SCHEMA_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	switch a.CacheBackend {
+	case CACHE_BACKEND_MEMCACHED:
+		selector, err := cache.NewMemcachedSelector(a.MemcachedAddrs, a.MemcachedTimeout)
+		if err != nil {
+			return nil, err
+		}
+		memcachedClient := memcache.NewFromSelector(selector)
+		memcachedClient.Timeout = a.MemcachedTimeout
+		memcachedClient.MaxIdleConns = a.MemcachedMaxIdle
+		backend := cache.NewMemcachedClient(memcachedClient, entryMarshaler, selector)
+		if a.MemcachedJournal == "" {
+			return backend, nil
+		}
+		log.Infof("Using memcached key journal at %s", a.MemcachedJournal)
+		return cache.NewJournalClient(backend, a.MemcachedJournal, handlers.CHUNK_KEY_PREFIX, handlers.BODY_KEY_PREFIX)
+	case CACHE_BACKEND_REDIS:
+		redisClient := redis.NewClient(&redis.Options{
+			Addr: a.RedisAddr,
+		})
+		return cache.NewRedisClient(redisClient, entryMarshaler), nil
+	case CACHE_BACKEND_FILE:
+		log.Infof("Using file cache at %s", a.CacheDir)
+		return cache.NewFileClient(a.CacheDir, a.CacheSize, entryMarshaler)
+	}
+	return nil, fmt.Errorf("Unknown cache backend: %s", a.CacheBackend)
+}
@@ -0,0 +1,216 @@
+package applications
+
+import (
+	"bufio"
+	"fmt"
+	"gbf-proxy/lib/admission"
+	"gbf-proxy/services/handlers"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_PREFETCH_CONCURRENCY = 8
+	PREFETCH_PROGRESS_INTERVAL   = time.Second
+)
+
+// Matches requests in both the proxy's own log and common access log formats
+var accessLogURLRegexp = regexp.MustCompile(`\bGET (https?://[^\s"]+)`)
+
+type PrefetchApp struct {
+	MonolithicApp
+	Sources     []string
+	Concurrency int
+	Output      io.Writer
+}
+
+type prefetchStats struct {
+	total   int64
+	done    int64
+	fetched int64
+	cached  int64
+	failed  int64
+	skipped int64
+	bytes   int64
+}
+
+var _ Application = (*PrefetchApp)(nil)
+
+func (a PrefetchApp) Start() error {
+	if a.Output == nil {
+		a.Output = os.Stdout
+	}
+	if a.Concurrency <= 0 {
+		a.Concurrency = DEFAULT_PREFETCH_CONCURRENCY
+	}
+
+	// Prefetched assets are wanted in the cache no matter how often they
+	// have been requested.
+	a.Admission = admission.FILTER_NONE
+	c, hostRules, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	proxyHandler := handlers.NewProxyHandler()
+	cacheHandler, err := a.createCacheHandler(proxyHandler, c, hostRules)
+	if err != nil {
+		return err
+	}
+	defer cacheHandler.Close()
+	authority, err := a.loadAuthority()
+	if err != nil {
+		return err
+	}
+	gatewayHandler := handlers.NewGatewayHandler(a.Version, cacheHandler, nil, hostRules, authority)
+
+	urls, err := a.readURLs()
+	if err != nil {
+		return err
+	}
+	stats := &prefetchStats{}
+	reqs := make([]*http.Request, 0, len(urls))
+	for _, u := range urls {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			log.Error(err)
+			stats.failed++
+			continue
+		}
+		// Only plain HTTP asset requests are intercepted by the gateway, and
+		// HTTPS ones when it has a CA to intercept them with, so anything
+		// else would never be served from the cache.
+		intercepted := req.URL.Scheme == "http" || (req.URL.Scheme == "https" && authority != nil)
+		if !intercepted || !gatewayHandler.RequestAllowed(req) ||
+			!gatewayHandler.AssetRequest(req) || !cacheHandler.ShouldCacheRequest(req) {
+			stats.skipped++
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	stats.total = int64(len(reqs))
+
+	queue := make(chan *http.Request)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < a.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				a.prefetch(cacheHandler, req, stats)
+				atomic.AddInt64(&stats.done, 1)
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	go a.printProgress(stats, stop)
+	for _, req := range reqs {
+		queue <- req
+	}
+	close(queue)
+	wg.Wait()
+	cacheHandler.Wait()
+	close(stop)
+
+	fmt.Fprintf(a.Output, "Fetched: %d\n", stats.fetched)
+	fmt.Fprintf(a.Output, "Already cached: %d\n", stats.cached)
+	fmt.Fprintf(a.Output, "Failed: %d\n", stats.failed)
+	fmt.Fprintf(a.Output, "Skipped: %d\n", stats.skipped)
+	fmt.Fprintf(a.Output, "Bytes: %d\n", stats.bytes)
+	return nil
+}
+
+func (a PrefetchApp) prefetch(cacheHandler *handlers.CacheHandler, req *http.Request, stats *prefetchStats) {
+	cached, err := cacheHandler.Cached(req)
+	if err != nil {
+		log.Error(err)
+	} else if cached {
+		atomic.AddInt64(&stats.cached, 1)
+		return
+	}
+	res, err := cacheHandler.HandleRequest(req, handlers.RequestContext{
+		Logger: log,
+	})
+	if err != nil {
+		log.Error(err)
+		atomic.AddInt64(&stats.failed, 1)
+		return
+	}
+	defer res.Body.Close()
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	atomic.AddInt64(&stats.bytes, n)
+	if err != nil {
+		log.Error(err)
+		atomic.AddInt64(&stats.failed, 1)
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		log.Errorf("Prefetch failed: %s responded with %s", req.URL, res.Status)
+		atomic.AddInt64(&stats.failed, 1)
+	} else {
+		atomic.AddInt64(&stats.fetched, 1)
+	}
+}
+
+func (a PrefetchApp) printProgress(stats *prefetchStats, stop chan struct{}) {
+	ticker := time.NewTicker(PREFETCH_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Infof("Prefetched %d/%d URLs", atomic.LoadInt64(&stats.done), stats.total)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (a PrefetchApp) readURLs() ([]string, error) {
+	sources := a.Sources
+	if len(sources) <= 0 {
+		sources = []string{"-"}
+	}
+	seen := make(map[string]bool)
+	urls := make([]string, 0)
+	for _, source := range sources {
+		err := readSource(source, func(u string) {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+func readSource(source string, fn func(string)) error {
+	r := io.Reader(os.Stdin)
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			fn(strings.Fields(line)[0])
+		} else if m := accessLogURLRegexp.FindStringSubmatch(line); m != nil {
+			fn(m[1])
+		}
+	}
+	return scanner.Err()
+}
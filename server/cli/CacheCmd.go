@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"fmt"
+	"gbf-proxy/applications"
+	"gbf-proxy/lib/cachekey"
+	"gbf-proxy/lib/config"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCacheCmd(newApp func() applications.MonolithicApp) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and manage the asset cache",
+	}
+	cmd.AddCommand(newCacheKeyCmd(newApp))
+	cmd.AddCommand(newCacheExportCmd(newApp))
+	cmd.AddCommand(newCacheImportCmd(newApp))
+	return cmd
+}
+
+func newCacheKeyCmd(newApp func() applications.MonolithicApp) *cobra.Command {
+	return &cobra.Command{
+		Use:   "key <url>...",
+		Short: "Print the cache keys the given URLs map to",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := config.Load(newApp().ConfigPath)
+			if err != nil {
+				return err
+			}
+			n, err := cachekey.NewNormalizer(c.CacheKeys)
+			if err != nil {
+				return err
+			}
+			for _, arg := range args {
+				u, err := url.Parse(arg)
+				if err != nil {
+					return err
+				}
+				fmt.Println(n.Key(u))
+			}
+			return nil
+		},
+	}
+}
+
+func newCacheExportCmd(newApp func() applications.MonolithicApp) *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <file>",
+		Short: "Export the cache entries into a tar archive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Logs are written to stdout, so the archive can't be.
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := newApp().ExportCache(f)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d entries\n", n)
+			return nil
+		},
+	}
+}
+
+func newCacheImportCmd(newApp func() applications.MonolithicApp) *cobra.Command {
+	return &cobra.Command{
+		Use:   "import <file|->",
+		Short: "Import the cache entries from a tar archive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r := io.Reader(os.Stdin)
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			n, err := newApp().ImportCache(r)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Imported %d entries\n", n)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"gbf-proxy/applications"
+
+	"github.com/spf13/cobra"
+)
+
+func NewPrefetchCmd(newApp func() applications.MonolithicApp) *cobra.Command {
+	concurrency := applications.DEFAULT_PREFETCH_CONCURRENCY
+	cmd := &cobra.Command{
+		Use:   "prefetch [file|-]...",
+		Short: "Warm up the cache with URLs from files, access logs or stdin",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return (applications.PrefetchApp{
+				MonolithicApp: newApp(),
+				Sources:       args,
+				Concurrency:   concurrency,
+				Output:        cmd.OutOrStdout(),
+			}).Start()
+		},
+	}
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", concurrency, "Number of concurrent fetches")
+	return cmd
+}
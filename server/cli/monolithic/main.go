@@ -3,15 +3,41 @@ package main
 import (
 	"gbf-proxy/applications"
 	"gbf-proxy/cli"
+	"gbf-proxy/lib/admission"
+	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/compression"
 	"gbf-proxy/lib/logger"
+	"gbf-proxy/services/handlers"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/spf13/cobra"
 )
 
 var (
-	webHost       = "localhost"
-	webAddr       = "127.0.0.1:80"
-	memcachedAddr = "127.0.0.1:11211"
+	configPath       = ""
+	webHost          = "localhost"
+	webAddr          = "127.0.0.1:80"
+	memcachedAddrs   = []string{"127.0.0.1:11211"}
+	memcachedJournal = ""
+	memcachedTimeout = memcache.DefaultTimeout
+	memcachedMaxIdle = memcache.DefaultMaxIdleConns
+	breakerFailures  = cache.DEFAULT_BREAKER_FAILURES
+	breakerTimeout   = cache.DEFAULT_BREAKER_TIMEOUT
+	redisAddr        = "127.0.0.1:6379"
+	cacheBackend     = applications.CACHE_BACKEND_MEMCACHED
+	cacheDir         = "cache"
+	cacheSize        = int64(1024)
+	cacheCompression = compression.CODEC_NONE
+	admissionFilter  = admission.FILTER_NONE
+	admissionWindow  = admission.DEFAULT_WINDOW
+	memoryCache      = int64(0)
+	adminAddr        = ""
+	adminToken       = ""
+	mitmCACert       = ""
+	mitmCAKey        = ""
+
+	coalesceTimeout = handlers.DEFAULT_COALESCE_TIMEOUT
+	negativeTTL     = handlers.DEFAULT_NEGATIVE_TTL
 
 	version   string = "undefined"
 	buildTime string = "0"
@@ -24,14 +50,9 @@ var (
 		Short: "Start the monolithic Granblue Proxy service",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			listenerAddr := args[0]
-			err := (applications.MonolithicApp{
-				Version:       version,
-				WebHost:       webHost,
-				WebAddr:       webAddr,
-				ListenerAddr:  listenerAddr,
-				MemcachedAddr: memcachedAddr,
-			}).Start()
+			app := newMonolithicApp()
+			app.ListenerAddr = args[0]
+			err := app.Start()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -41,8 +62,60 @@ var (
 
 func main() {
 	rootCmd.AddCommand(cli.NewVersionCmd(version, buildTime))
+	rootCmd.AddCommand(cli.NewCacheCmd(newMonolithicApp))
+	rootCmd.AddCommand(cli.NewPrefetchCmd(newMonolithicApp))
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", configPath, "Configuration file")
 	rootCmd.PersistentFlags().StringVar(&webHost, "web-hostname", webHost, "Web server hostname")
 	rootCmd.PersistentFlags().StringVar(&webAddr, "web-address", webAddr, "Web server address")
-	rootCmd.PersistentFlags().StringVarP(&memcachedAddr, "memcached", "m", memcachedAddr, "Memcached address")
+	rootCmd.PersistentFlags().StringSliceVarP(&memcachedAddrs, "memcached", "m", memcachedAddrs, "Memcached addresses, comma separated or repeated")
+	rootCmd.PersistentFlags().DurationVar(&memcachedTimeout, "memcached-timeout", memcachedTimeout, "Memcached connect, read and write timeout")
+	rootCmd.PersistentFlags().IntVar(&memcachedMaxIdle, "memcached-max-idle", memcachedMaxIdle, "Maximum number of idle connections kept for each memcached node")
+	rootCmd.PersistentFlags().StringVar(&memcachedJournal, "memcached-journal", memcachedJournal, "File to record memcached keys in so that they can be listed")
+	rootCmd.PersistentFlags().StringVar(&redisAddr, "redis", redisAddr, "Redis address")
+	rootCmd.PersistentFlags().StringVar(&cacheBackend, "cache", cacheBackend, "Cache backend (memcached, redis, file)")
+	rootCmd.PersistentFlags().IntVar(&breakerFailures, "cache-breaker-failures", breakerFailures, "Consecutive cache failures after which the cache is bypassed")
+	rootCmd.PersistentFlags().DurationVar(&breakerTimeout, "cache-breaker-timeout", breakerTimeout, "How long the cache is bypassed before it is tried again")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", cacheDir, "File cache directory")
+	rootCmd.PersistentFlags().Int64Var(&cacheSize, "cache-size", cacheSize, "File cache size limit in megabytes")
+	rootCmd.PersistentFlags().StringVar(&cacheCompression, "cache-compression", cacheCompression, "Compression for cached bodies (none, gzip, snappy)")
+	rootCmd.PersistentFlags().StringVar(&admissionFilter, "admission", admissionFilter, "Admission filter for new cache entries (none, tinylfu, second-hit)")
+	rootCmd.PersistentFlags().DurationVar(&admissionWindow, "admission-window", admissionWindow, "Window within which the second-hit filter expects a repeated request")
+	rootCmd.PersistentFlags().Int64Var(&memoryCache, "memory-cache", memoryCache, "In-memory cache size limit in megabytes (0 to disable)")
+	rootCmd.PersistentFlags().StringVar(&adminAddr, "admin-address", adminAddr, "Admin server address (disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "admin-token", adminToken, "Bearer token required by the admin server")
+	rootCmd.PersistentFlags().StringVar(&mitmCACert, "mitm-ca-cert", mitmCACert, "CA certificate to intercept HTTPS asset requests with (disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&mitmCAKey, "mitm-ca-key", mitmCAKey, "Private key of the CA certificate used to intercept HTTPS asset requests")
+	rootCmd.PersistentFlags().DurationVar(&coalesceTimeout, "coalesce-timeout", coalesceTimeout, "Maximum time to wait for a concurrent fetch of the same asset")
+	rootCmd.PersistentFlags().DurationVar(&negativeTTL, "negative-ttl", negativeTTL, "How long to cache 404 and 410 responses for (0 to disable)")
 	rootCmd.Execute()
 }
+
+func newMonolithicApp() applications.MonolithicApp {
+	return applications.MonolithicApp{
+		Version:          version,
+		ConfigPath:       configPath,
+		WebHost:          webHost,
+		WebAddr:          webAddr,
+		MemcachedAddrs:   memcachedAddrs,
+		MemcachedJournal: memcachedJournal,
+		MemcachedTimeout: memcachedTimeout,
+		MemcachedMaxIdle: memcachedMaxIdle,
+		BreakerFailures:  breakerFailures,
+		BreakerTimeout:   breakerTimeout,
+		RedisAddr:        redisAddr,
+		CacheBackend:     cacheBackend,
+		CacheDir:         cacheDir,
+		CacheSize:        cacheSize * 1024 * 1024,
+		CacheCompression: cacheCompression,
+		Admission:        admissionFilter,
+		AdmissionWindow:  admissionWindow,
+		MemoryCache:      memoryCache * 1024 * 1024,
+		AdminAddr:        adminAddr,
+		AdminToken:       adminToken,
+		MitmCACert:       mitmCACert,
+		MitmCAKey:        mitmCAKey,
+
+		CoalesceTimeout: coalesceTimeout,
+		NegativeTTL:     negativeTTL,
+	}
+}
@@ -0,0 +1,43 @@
+package admission
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	FILTER_NONE       = "none"
+	FILTER_TINYLFU    = "tinylfu"
+	FILTER_SECOND_HIT = "second-hit"
+
+	DEFAULT_WINDOW = 10 * time.Minute
+)
+
+// Filter decides which responses are worth storing, so that assets that are
+// only requested once don't push out the ones that are requested often.
+type Filter interface {
+	// Admit records a request for the key and reports whether the response
+	// to it should be stored.
+	Admit(key string) bool
+}
+
+// New returns the filter with the given name, or nil for "none" and "". The
+// window only applies to the second hit filter.
+func New(name string, window time.Duration) (Filter, error) {
+	switch name {
+	case "", FILTER_NONE:
+		return nil, nil
+	case FILTER_TINYLFU:
+		return NewTinyLFU(), nil
+	case FILTER_SECOND_HIT:
+		return NewSecondHit(window), nil
+	}
+	return nil, fmt.Errorf("Unknown admission filter: %s", name)
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
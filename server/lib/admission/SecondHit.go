@@ -0,0 +1,60 @@
+package admission
+
+import (
+	"sync"
+	"time"
+)
+
+// SecondHit admits a key when it was already requested within the window.
+// Keys are kept for up to two windows, in two generations that are swapped
+// once a window has passed.
+type SecondHit struct {
+	window time.Duration
+
+	mutex    sync.Mutex
+	current  map[uint64]time.Time
+	previous map[uint64]time.Time
+	rotated  time.Time
+}
+
+var _ Filter = (*SecondHit)(nil)
+
+func NewSecondHit(window time.Duration) *SecondHit {
+	if window <= 0 {
+		window = DEFAULT_WINDOW
+	}
+	return &SecondHit{
+		window:   window,
+		current:  make(map[uint64]time.Time),
+		previous: make(map[uint64]time.Time),
+		rotated:  time.Now(),
+	}
+}
+
+func (f *SecondHit) Admit(key string) bool {
+	h := hashKey(key)
+	now := time.Now()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rotate(now)
+	seen, ok := f.current[h]
+	if !ok {
+		seen, ok = f.previous[h]
+	}
+	f.current[h] = now
+	return ok && now.Sub(seen) <= f.window
+}
+
+func (f *SecondHit) rotate(now time.Time) {
+	elapsed := now.Sub(f.rotated)
+	if elapsed < f.window {
+		return
+	}
+	if elapsed < 2*f.window {
+		f.previous = f.current
+	} else {
+		f.previous = make(map[uint64]time.Time)
+	}
+	f.current = make(map[uint64]time.Time)
+	f.rotated = now
+}
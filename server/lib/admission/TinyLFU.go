@@ -0,0 +1,82 @@
+package admission
+
+import (
+	"sync"
+)
+
+const (
+	TINYLFU_SKETCH_WIDTH = 1 << 16
+	TINYLFU_SKETCH_DEPTH = 4
+	TINYLFU_SAMPLE_SIZE  = 10 * TINYLFU_SKETCH_WIDTH
+	TINYLFU_MAX_COUNT    = 15
+	TINYLFU_MIN_COUNT    = 2
+)
+
+// TinyLFU estimates how often keys are requested with a count-min sketch
+// and admits those that have been requested at least twice. The counts are
+// halved after every sample so that keys that were popular a while ago
+// don't stay admitted forever.
+type TinyLFU struct {
+	mutex     sync.Mutex
+	counters  [TINYLFU_SKETCH_DEPTH][]uint8
+	additions int
+}
+
+var _ Filter = (*TinyLFU)(nil)
+
+func NewTinyLFU() *TinyLFU {
+	f := &TinyLFU{}
+	for i := range f.counters {
+		f.counters[i] = make([]uint8, TINYLFU_SKETCH_WIDTH)
+	}
+	return f
+}
+
+func (f *TinyLFU) Admit(key string) bool {
+	h := hashKey(key)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	count := f.increment(h)
+	f.additions++
+	if f.additions >= TINYLFU_SAMPLE_SIZE {
+		f.reset()
+	}
+	return count >= TINYLFU_MIN_COUNT
+}
+
+// increment only raises the smallest counters for the key, which keeps the
+// overestimate from collisions down, and returns the new estimate.
+func (f *TinyLFU) increment(h uint64) uint8 {
+	var indexes [TINYLFU_SKETCH_DEPTH]uint32
+	min := uint8(TINYLFU_MAX_COUNT)
+	for i := range f.counters {
+		indexes[i] = sketchIndex(h, i)
+		if c := f.counters[i][indexes[i]]; c < min {
+			min = c
+		}
+	}
+	if min >= TINYLFU_MAX_COUNT {
+		return min
+	}
+	for i := range f.counters {
+		if f.counters[i][indexes[i]] == min {
+			f.counters[i][indexes[i]]++
+		}
+	}
+	return min + 1
+}
+
+func (f *TinyLFU) reset() {
+	for i := range f.counters {
+		for j := range f.counters[i] {
+			f.counters[i][j] /= 2
+		}
+	}
+	f.additions /= 2
+}
+
+func sketchIndex(h uint64, row int) uint32 {
+	h1 := uint32(h)
+	h2 := uint32(h >> 32)
+	return (h1 + uint32(row)*h2) % TINYLFU_SKETCH_WIDTH
+}
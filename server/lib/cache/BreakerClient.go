@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"gbf-proxy/lib/logger"
+	"gbf-proxy/lib/metrics"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	BREAKER_CLOSED = iota
+	BREAKER_OPEN
+	BREAKER_HALF_OPEN
+
+	DEFAULT_BREAKER_FAILURES = 5
+	DEFAULT_BREAKER_TIMEOUT  = 10 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("cache: circuit breaker is open")
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+// BreakerClient stops calling a backend that keeps failing. Once the given
+// number of consecutive calls have failed, calls fail with ErrCircuitOpen
+// right away until the timeout has passed. A single call is then let
+// through to probe the backend, which closes the circuit again if it
+// succeeds.
+type BreakerClient struct {
+	backend  Client
+	failures int
+	timeout  time.Duration
+	log      *logger.Logger
+
+	mutex    sync.Mutex
+	state    int
+	failed   int
+	openedAt time.Time
+	probing  bool
+
+	trips    *metrics.Counter
+	rejected *metrics.Counter
+}
+
+var _ Client = (*BreakerClient)(nil)
+
+func NewBreakerClient(backend Client, failures int, timeout time.Duration) *BreakerClient {
+	if failures <= 0 {
+		failures = DEFAULT_BREAKER_FAILURES
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_BREAKER_TIMEOUT
+	}
+	registry := metrics.DefaultRegistry
+	c := &BreakerClient{
+		backend:  backend,
+		failures: failures,
+		timeout:  timeout,
+		log:      logger.DefaultLogger,
+		trips:    registry.Counter("cache.breaker.trips"),
+		rejected: registry.Counter("cache.breaker.rejected"),
+	}
+	registry.Gauge("cache.breaker.state", c.State)
+	return c
+}
+
+func (c *BreakerClient) Get(ctx context.Context, key string, value interface{}) error {
+	return c.call(func() error {
+		return c.backend.Get(ctx, key, value)
+	})
+}
+
+func (c *BreakerClient) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	return c.call(func() error {
+		return c.backend.GetMulti(ctx, values)
+	})
+}
+
+func (c *BreakerClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.call(func() error {
+		return c.backend.Set(ctx, key, value, ttl)
+	})
+}
+
+func (c *BreakerClient) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	return c.call(func() error {
+		return c.backend.Touch(ctx, key, ttl)
+	})
+}
+
+func (c *BreakerClient) Delete(ctx context.Context, key string) error {
+	return c.call(func() error {
+		return c.backend.Delete(ctx, key)
+	})
+}
+
+func (c *BreakerClient) DeletePrefix(ctx context.Context, prefix string) error {
+	return c.call(func() error {
+		return c.backend.DeletePrefix(ctx, prefix)
+	})
+}
+
+func (c *BreakerClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.call(func() error {
+		var err error
+		keys, err = c.backend.Keys(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (c *BreakerClient) Stats() Stats {
+	return c.backend.Stats()
+}
+
+func (c *BreakerClient) Close() error {
+	return c.backend.Close()
+}
+
+// State is one of BREAKER_CLOSED, BREAKER_OPEN or BREAKER_HALF_OPEN.
+func (c *BreakerClient) State() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int64(c.state)
+}
+
+func (c *BreakerClient) call(fn func() error) error {
+	if !c.allow() {
+		c.rejected.Inc()
+		return ErrCircuitOpen
+	}
+	err := fn()
+	c.record(breakerFailure(err))
+	return err
+}
+
+func (c *BreakerClient) allow() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch c.state {
+	case BREAKER_OPEN:
+		if time.Since(c.openedAt) < c.timeout {
+			return false
+		}
+		c.transition(BREAKER_HALF_OPEN)
+		c.probing = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+func (c *BreakerClient) record(failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch c.state {
+	case BREAKER_HALF_OPEN:
+		c.probing = false
+		if failed {
+			c.open()
+		} else {
+			c.failed = 0
+			c.transition(BREAKER_CLOSED)
+		}
+	case BREAKER_CLOSED:
+		if !failed {
+			c.failed = 0
+			return
+		}
+		c.failed++
+		if c.failed >= c.failures {
+			c.open()
+		}
+	}
+}
+
+func (c *BreakerClient) open() {
+	c.openedAt = time.Now()
+	c.trips.Inc()
+	c.transition(BREAKER_OPEN)
+}
+
+func (c *BreakerClient) transition(state int) {
+	if c.state == state {
+		return
+	}
+	if state == BREAKER_OPEN {
+		c.log.Errorf("Cache circuit breaker %s -> %s", breakerStateNames[c.state], breakerStateNames[state])
+	} else {
+		c.log.Infof("Cache circuit breaker %s -> %s", breakerStateNames[c.state], breakerStateNames[state])
+	}
+	c.state = state
+}
+
+// breakerFailure reports whether an error means that the backend is
+// unavailable. Errors caused by the entry or the call itself, such as a key
+// that is too long, only fail that call, so that a client can't open the
+// circuit for everyone by sending requests that can't be cached.
+func breakerFailure(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case memcache.ErrNoServers, context.DeadlineExceeded, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	switch err.(type) {
+	case net.Error, *memcache.ConnectTimeoutError:
+		return true
+	}
+	return redisUnavailable(err)
+}
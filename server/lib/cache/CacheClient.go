@@ -1,7 +1,39 @@
 package cache
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const DEFAULT_EXPIRATION = 24 * time.Hour
+
+var (
+	ErrCacheMiss    = errors.New("cache: cache miss")
+	ErrNotSupported = errors.New("cache: operation not supported")
+)
+
+// Client stores cache entries in a backend. Entries that the marshaler fails
+// to decode, for example because they were written in another format by a
+// different version of the proxy, are evicted and reported as misses by
+// every client.
 type Client interface {
-	Get(key string, value interface{}) error
-	Set(key string, value interface{}) error
-	Has(key string) (bool, error)
+	Get(ctx context.Context, key string, value interface{}) error
+	GetMulti(ctx context.Context, values map[string]interface{}) error
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	// Touch extends the expiration of an existing entry without rewriting it.
+	Touch(ctx context.Context, key string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	DeletePrefix(ctx context.Context, prefix string) error
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	Stats() Stats
+	// Close releases the connections and background work of the client.
+	Close() error
+}
+
+func expiration(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DEFAULT_EXPIRATION
+	}
+	return ttl
 }
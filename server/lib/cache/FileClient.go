@@ -0,0 +1,435 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"gbf-proxy/lib/marshaler"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_CACHE_TEMP_DIR    = "tmp"
+	FILE_CACHE_HEADER_SIZE = 10
+)
+
+type FileClient struct {
+	marshaler.Marshaler
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	stats   statsCounter
+}
+
+type fileEntry struct {
+	key     string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+var _ Client = (*FileClient)(nil)
+
+func NewFileClient(dir string, maxSize int64, m marshaler.Marshaler) (*FileClient, error) {
+	c := &FileClient{
+		Marshaler: m,
+		dir:       dir,
+		maxSize:   maxSize,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+	if err := c.recover(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *FileClient) Get(ctx context.Context, key string, value interface{}) error {
+	return c.stats.get(c.get(ctx, key, value))
+}
+
+func (c *FileClient) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	requested := len(values)
+	for key, value := range values {
+		err := c.get(ctx, key, value)
+		if err == ErrCacheMiss {
+			delete(values, key)
+		} else if err != nil {
+			return c.stats.getMulti(requested, 0, err)
+		}
+	}
+	return c.stats.getMulti(requested, len(values), nil)
+}
+
+func (c *FileClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := c.Marshaler.Marshal(value)
+	if err != nil {
+		return c.stats.set(err)
+	}
+	return c.stats.set(c.write(key, b, ttl))
+}
+
+func (c *FileClient) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := c.fileName(key)
+	c.mutex.Lock()
+	_, ok := c.entries[name]
+	c.mutex.Unlock()
+	if !ok {
+		return ErrCacheMiss
+	}
+
+	f, err := os.OpenFile(c.filePath(name), os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.remove(name)
+			return ErrCacheMiss
+		}
+		return err
+	}
+	defer f.Close()
+	_, expiresAt, err := readFileHeader(f)
+	if err != nil {
+		return err
+	}
+	if expired(expiresAt) {
+		c.remove(name)
+		return ErrCacheMiss
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(time.Now().Add(expiration(ttl)).Unix()))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	c.touch(name)
+	return nil
+}
+
+func (c *FileClient) Delete(ctx context.Context, key string) error {
+	return c.stats.delete(c.remove(c.fileName(key)), nil)
+}
+
+func (c *FileClient) DeletePrefix(ctx context.Context, prefix string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deleted := 0
+	for _, el := range c.entries {
+		if strings.HasPrefix(el.Value.(*fileEntry).key, prefix) {
+			c.removeElement(el)
+			deleted++
+		}
+	}
+	return c.stats.delete(deleted, nil)
+}
+
+func (c *FileClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keys := make([]string, 0)
+	for _, el := range c.entries {
+		key := el.Value.(*fileEntry).key
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *FileClient) Stats() Stats {
+	return c.stats.stats()
+}
+
+func (c *FileClient) Close() error {
+	return nil
+}
+
+func (c *FileClient) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+func (c *FileClient) get(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := c.fileName(key)
+	b, err := c.read(name)
+	if err != nil {
+		return err
+	}
+	if err := c.Marshaler.Unmarshal(b, value); err != nil {
+		c.remove(name)
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+func (c *FileClient) read(name string) ([]byte, error) {
+	c.mutex.Lock()
+	_, ok := c.entries[name]
+	c.mutex.Unlock()
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	path := c.filePath(name)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.remove(name)
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	defer f.Close()
+	_, expiresAt, err := readFileHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if expired(expiresAt) {
+		c.remove(name)
+		return nil, ErrCacheMiss
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	c.touch(name)
+	return b, nil
+}
+
+func (c *FileClient) write(key string, b []byte, ttl time.Duration) error {
+	if len(key) > math.MaxUint16 {
+		return fmt.Errorf("cache: key of %d bytes is too long", len(key))
+	}
+	name := c.fileName(key)
+	size := int64(FILE_CACHE_HEADER_SIZE + len(key) + len(b))
+	if size > c.maxSize {
+		return fmt.Errorf("cache: entry %s of %d bytes exceeds cache size", key, size)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, FILE_CACHE_TEMP_DIR), name)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(expiration(ttl)).Unix()
+	err = writeFile(tmp, key, expiresAt, b)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	path := c.filePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.insert(&fileEntry{
+		key:     key,
+		name:    name,
+		size:    size,
+		modTime: time.Now(),
+	})
+	c.evict()
+	return nil
+}
+
+func (c *FileClient) touch(name string) {
+	now := time.Now()
+	c.mutex.Lock()
+	if el, ok := c.entries[name]; ok {
+		el.Value.(*fileEntry).modTime = now
+		c.lru.MoveToFront(el)
+	}
+	c.mutex.Unlock()
+	// The modification time doubles as the access time so that the LRU
+	// order survives a restart.
+	os.Chtimes(c.filePath(name), now, now)
+}
+
+func (c *FileClient) remove(name string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.removeElement(el)
+		return 1
+	}
+	return 0
+}
+
+func (c *FileClient) insert(e *fileEntry) {
+	if el, ok := c.entries[e.name]; ok {
+		c.size -= el.Value.(*fileEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[e.name] = c.lru.PushFront(e)
+	c.size += e.size
+}
+
+func (c *FileClient) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *FileClient) removeElement(el *list.Element) {
+	e := el.Value.(*fileEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	os.Remove(c.filePath(e.name))
+}
+
+// recover loads the entries left by a previous run. Only files laid out
+// like entries are looked at, so that pointing the cache at a directory
+// that holds anything else doesn't lose those files.
+func (c *FileClient) recover() error {
+	tmpDir := filepath.Join(c.dir, FILE_CACHE_TEMP_DIR)
+	tmpFiles, err := ioutil.ReadDir(tmpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range tmpFiles {
+		if len(info.Name()) > sha1.Size*2 && validFileName(info.Name()[:sha1.Size*2]) {
+			if err := os.Remove(filepath.Join(tmpDir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	found := make([]*fileEntry, 0)
+	err = filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !validFileName(info.Name()) || path != c.filePath(info.Name()) {
+			return nil
+		}
+		key, ok := c.validFile(path)
+		if !ok {
+			return os.Remove(path)
+		}
+		found = append(found, &fileEntry{
+			key:     key,
+			name:    info.Name(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range found {
+		c.insert(e)
+	}
+	c.evict()
+	return nil
+}
+
+func (c *FileClient) validFile(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	key, expiresAt, err := readFileHeader(f)
+	if err != nil {
+		return "", false
+	}
+	return key, filepath.Base(path) == c.fileName(key) && !expired(expiresAt)
+}
+
+func validFileName(name string) bool {
+	if len(name) != sha1.Size*2 || strings.ToLower(name) != name {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func (c *FileClient) fileName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *FileClient) filePath(name string) string {
+	return filepath.Join(c.dir, name[0:2], name[2:4], name)
+}
+
+func writeFile(f *os.File, key string, expiresAt int64, b []byte) error {
+	defer f.Close()
+	header := make([]byte, FILE_CACHE_HEADER_SIZE)
+	binary.BigEndian.PutUint64(header[0:8], uint64(expiresAt))
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(key)))
+	for _, chunk := range [][]byte{header, []byte(key), b} {
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func readFileHeader(r io.Reader) (string, int64, error) {
+	header := make([]byte, FILE_CACHE_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	expiresAt := int64(binary.BigEndian.Uint64(header[0:8]))
+	key := make([]byte, binary.BigEndian.Uint16(header[8:10]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", 0, err
+	}
+	return string(key), expiresAt, nil
+}
+
+func expired(expiresAt int64) bool {
+	return time.Now().Unix() >= expiresAt
+}
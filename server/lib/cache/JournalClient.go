@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	JOURNAL_LOCK_SUFFIX = ".lock"
+	JOURNAL_SET         = '+'
+	JOURNAL_DELETE      = '-'
+)
+
+// JournalClient records the keys written to a backend that can't enumerate
+// its own keys, such as memcached. Keys of entries that have since expired
+// or been evicted stay in the journal, so they may turn out to be misses.
+//
+// Several processes may share a journal, such as the proxy and the cache
+// commands. Each holds a shared lock on it, and only a process that finds
+// no one else using the journal compacts it.
+type JournalClient struct {
+	Client
+	path   string
+	ignore []string
+
+	mutex sync.Mutex
+	file  *os.File
+	lock  *os.File
+	keys  map[string]bool
+}
+
+var _ Client = (*JournalClient)(nil)
+
+// NewJournalClient creates a journal that leaves out the keys with the
+// given prefixes, such as those of entries that are only reached through
+// other entries.
+func NewJournalClient(backend Client, path string, ignore ...string) (*JournalClient, error) {
+	c := &JournalClient{
+		Client: backend,
+		path:   path,
+		ignore: ignore,
+		keys:   make(map[string]bool),
+	}
+	if err := c.load(); err != nil {
+		if c.lock != nil {
+			c.lock.Close()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *JournalClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	err := c.Client.Set(ctx, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	return c.record(JOURNAL_SET, key)
+}
+
+func (c *JournalClient) Delete(ctx context.Context, key string) error {
+	err := c.Client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	return c.record(JOURNAL_DELETE, key)
+}
+
+func (c *JournalClient) DeletePrefix(ctx context.Context, prefix string) error {
+	keys, err := c.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := c.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *JournalClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keys := make([]string, 0)
+	for key := range c.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Close closes the journal, which releases its lock, and then the backend.
+func (c *JournalClient) Close() error {
+	c.mutex.Lock()
+	err := c.file.Close()
+	c.lock.Close()
+	c.mutex.Unlock()
+	if err := c.Client.Close(); err != nil {
+		return err
+	}
+	return err
+}
+
+func (c *JournalClient) ignored(key string) bool {
+	for _, prefix := range c.ignore {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *JournalClient) record(op byte, key string) error {
+	if c.ignored(key) {
+		return nil
+	}
+	if strings.ContainsAny(key, "\r\n") {
+		return fmt.Errorf("cache: key %q can't be journaled", key)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Deletions are always recorded, since another process sharing the
+	// journal may have set the key in the meantime.
+	if op == JOURNAL_SET && c.keys[key] {
+		return nil
+	}
+	if _, err := c.file.WriteString(string(op) + key + "\n"); err != nil {
+		return err
+	}
+	if op == JOURNAL_SET {
+		c.keys[key] = true
+	} else {
+		delete(c.keys, key)
+	}
+	return nil
+}
+
+// load reads the existing journal, and compacts it if no other process is
+// using it, since keys that are deleted and set again get appended more
+// than once.
+func (c *JournalClient) load() error {
+	lock, err := os.OpenFile(c.path+JOURNAL_LOCK_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	c.lock = lock
+	fd := int(lock.Fd())
+	owner := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB) == nil
+	if !owner {
+		if err := syscall.Flock(fd, syscall.LOCK_SH); err != nil {
+			return err
+		}
+	}
+
+	if err := c.read(); err != nil {
+		return err
+	}
+	if owner {
+		if err := c.compact(); err != nil {
+			return err
+		}
+		// Let the other processes in once the journal is in place
+		if err := syscall.Flock(fd, syscall.LOCK_SH); err != nil {
+			return err
+		}
+	}
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+func (c *JournalClient) read() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case JOURNAL_SET:
+			c.keys[line[1:]] = true
+		case JOURNAL_DELETE:
+			delete(c.keys, line[1:])
+		}
+	}
+	for key := range c.keys {
+		if c.ignored(key) {
+			delete(c.keys, key)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *JournalClient) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for key := range c.keys {
+		w.WriteString(string(JOURNAL_SET) + key + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -1,54 +1,224 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"gbf-proxy/lib/marshaler"
+	"math"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
-const DEFAULT_MEMCACHED_EXPIRATION = 86400
+const (
+	// Memcached treats expirations longer than 30 days as absolute Unix timestamps
+	MEMCACHED_MAX_RELATIVE_EXPIRATION = 30 * 24 * time.Hour
+
+	MEMCACHED_MAX_KEY_LENGTH    = 250
+	MEMCACHED_HASHED_KEY_PREFIX = "sha256:"
+	// Set on items whose value starts with the original key, because it was
+	// hashed to fit memcached
+	MEMCACHED_FLAG_HASHED_KEY = 1
+)
 
 type MemcachedClient struct {
 	*memcache.Client
 	marshaler.Marshaler
+	stats    statsCounter
+	selector *MemcachedSelector
 }
 
 var _ Client = (*MemcachedClient)(nil)
 
-func NewMemcachedClient(mc *memcache.Client, m marshaler.Marshaler) *MemcachedClient {
+// NewMemcachedClient creates a client that reports the nodes it can't reach
+// to the given selector, if any.
+func NewMemcachedClient(mc *memcache.Client, m marshaler.Marshaler, selector *MemcachedSelector) *MemcachedClient {
 	return &MemcachedClient{
 		Client:    mc,
 		Marshaler: m,
+		selector:  selector,
+	}
+}
+
+func (c *MemcachedClient) Get(ctx context.Context, key string, value interface{}) error {
+	return c.stats.get(c.report(c.get(ctx, key, value)))
+}
+
+func (c *MemcachedClient) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	requested := len(values)
+	err := c.report(c.getMulti(ctx, values))
+	return c.stats.getMulti(requested, len(values), err)
+}
+
+func (c *MemcachedClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.stats.set(c.report(c.set(ctx, key, value, ttl)))
+}
+
+func (c *MemcachedClient) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := c.Client.Touch(memcachedKey(key), memcachedExpiration(ttl))
+	if err == memcache.ErrCacheMiss {
+		return ErrCacheMiss
+	}
+	return c.report(err)
+}
+
+func (c *MemcachedClient) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return c.stats.delete(0, err)
+	}
+	err := c.Client.Delete(memcachedKey(key))
+	if err == memcache.ErrCacheMiss {
+		return c.stats.delete(0, nil)
+	}
+	return c.stats.delete(1, c.report(err))
+}
+
+func (c *MemcachedClient) DeletePrefix(ctx context.Context, prefix string) error {
+	return ErrNotSupported
+}
+
+func (c *MemcachedClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *MemcachedClient) Stats() Stats {
+	return c.stats.stats()
+}
+
+func (c *MemcachedClient) Close() error {
+	if c.selector == nil {
+		return nil
+	}
+	return c.selector.Close()
+}
+
+func (c *MemcachedClient) report(err error) error {
+	if err != nil && c.selector != nil {
+		c.selector.ReportError(err)
+	}
+	return err
+}
+
+func (c *MemcachedClient) get(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	item, err := c.Client.Get(memcachedKey(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return ErrCacheMiss
+		}
+		return err
 	}
+	return c.decode(key, item, value)
 }
 
-func (c *MemcachedClient) Get(key string, value interface{}) error {
-	item, err := c.Client.Get(key)
+func (c *MemcachedClient) getMulti(ctx context.Context, values map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, memcachedKey(key))
+	}
+	items, err := c.Client.GetMulti(keys)
 	if err != nil {
 		return err
 	}
-	return c.Marshaler.Unmarshal(item.Value, value)
+	for key, value := range values {
+		item, ok := items[memcachedKey(key)]
+		if !ok || c.decode(key, item, value) != nil {
+			delete(values, key)
+		}
+	}
+	return nil
+}
+
+// decode checks that the item was stored under the key that was asked for,
+// since hashed keys could collide, before unmarshaling it.
+func (c *MemcachedClient) decode(key string, item *memcache.Item, value interface{}) error {
+	b := item.Value
+	if item.Flags&MEMCACHED_FLAG_HASHED_KEY != 0 {
+		n := 2
+		if len(b) >= n {
+			n += int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < n {
+			c.Client.Delete(item.Key)
+			return ErrCacheMiss
+		}
+		if !bytes.Equal(b[2:n], []byte(key)) {
+			return ErrCacheMiss
+		}
+		b = b[n:]
+	} else if item.Key != key {
+		return ErrCacheMiss
+	}
+	if err := c.Marshaler.Unmarshal(b, value); err != nil {
+		c.Client.Delete(item.Key)
+		return ErrCacheMiss
+	}
+	return nil
 }
 
-func (c *MemcachedClient) Set(key string, value interface{}) error {
+func (c *MemcachedClient) set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(key) > math.MaxUint16 {
+		return fmt.Errorf("cache: key of %d bytes is too long", len(key))
+	}
 	b, err := c.Marshaler.Marshal(value)
 	if err != nil {
 		return err
 	}
-	return c.Client.Set(&memcache.Item{
-		Key:        key,
+	item := &memcache.Item{
+		Key:        memcachedKey(key),
 		Value:      b,
-		Expiration: DEFAULT_MEMCACHED_EXPIRATION,
-	})
+		Expiration: memcachedExpiration(ttl),
+	}
+	if item.Key != key {
+		header := make([]byte, 2, 2+len(key)+len(b))
+		binary.BigEndian.PutUint16(header, uint16(len(key)))
+		item.Value = append(append(header, key...), b...)
+		item.Flags = MEMCACHED_FLAG_HASHED_KEY
+	}
+	return c.Client.Set(item)
 }
 
-func (c *MemcachedClient) Has(key string) (bool, error) {
-	_, err := c.Client.Get(key)
-	if err != nil {
-		if err == memcache.ErrCacheMiss {
-			return false, nil
+// memcachedKey leaves keys that memcached accepts readable, and hashes the
+// ones that are too long or contain spaces or control characters.
+func memcachedKey(key string) string {
+	if validMemcachedKey(key) {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return MEMCACHED_HASHED_KEY_PREFIX + hex.EncodeToString(sum[:])
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) <= 0 || len(key) > MEMCACHED_MAX_KEY_LENGTH {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
 		}
-		return false, err
 	}
-	return true, nil
+	return true
+}
+
+func memcachedExpiration(ttl time.Duration) int32 {
+	ttl = expiration(ttl)
+	if ttl > MEMCACHED_MAX_RELATIVE_EXPIRATION {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	return int32(ttl / time.Second)
 }
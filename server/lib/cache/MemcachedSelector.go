@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"gbf-proxy/lib/logger"
+	"gbf-proxy/lib/metrics"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	MEMCACHED_RING_REPLICAS         = 160
+	MEMCACHED_HEALTH_CHECK_INTERVAL = time.Second
+	MEMCACHED_EJECT_FAILURES        = 2
+)
+
+// MemcachedSelector spreads keys over memcached nodes with consistent
+// hashing. Nodes that fail their health checks, or the requests sent to
+// them, are taken off the ring until they recover, so that only their share
+// of the keys is lost.
+type MemcachedSelector struct {
+	nodes   []*memcachedNode
+	timeout time.Duration
+	log     *logger.Logger
+	stop    chan struct{}
+	once    sync.Once
+
+	mutex sync.RWMutex
+	ring  []ringPoint
+}
+
+type memcachedNode struct {
+	addr     net.Addr
+	healthy  bool
+	failures int
+}
+
+type ringPoint struct {
+	hash uint32
+	node *memcachedNode
+}
+
+var _ memcache.ServerSelector = (*MemcachedSelector)(nil)
+
+func NewMemcachedSelector(addrs []string, timeout time.Duration) (*MemcachedSelector, error) {
+	if len(addrs) <= 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if timeout <= 0 {
+		timeout = memcache.DefaultTimeout
+	}
+	s := &MemcachedSelector{
+		nodes:   make([]*memcachedNode, 0, len(addrs)),
+		timeout: timeout,
+		log:     logger.DefaultLogger,
+		stop:    make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		a, err := resolveMemcachedAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		s.nodes = append(s.nodes, &memcachedNode{
+			addr:    a,
+			healthy: true,
+		})
+	}
+	s.rebuild()
+	metrics.DefaultRegistry.Gauge("memcached.healthy_nodes", s.HealthyNodes)
+	go s.monitor()
+	return s, nil
+}
+
+func (s *MemcachedSelector) PickServer(key string) (net.Addr, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.ring) <= 0 {
+		return nil, memcache.ErrNoServers
+	}
+	h := ringHash(key)
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i >= len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].node.addr, nil
+}
+
+func (s *MemcachedSelector) Each(fn func(net.Addr) error) error {
+	s.mutex.RLock()
+	addrs := make([]net.Addr, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		if node.healthy {
+			addrs = append(addrs, node.addr)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, addr := range addrs {
+		if err := fn(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemcachedSelector) HealthyNodes() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	healthy := int64(0)
+	for _, node := range s.nodes {
+		if node.healthy {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// Close stops the health checks.
+func (s *MemcachedSelector) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// ReportError counts an error of a request against the node it was sent
+// to, when the error means that the node can't be reached, so that a dead
+// node is ejected without waiting for the health checks to notice.
+func (s *MemcachedSelector) ReportError(err error) {
+	var addr net.Addr
+	switch e := err.(type) {
+	case *memcache.ConnectTimeoutError:
+		addr = e.Addr
+	case *net.OpError:
+		addr = e.Addr
+	}
+	if addr == nil {
+		return
+	}
+	for _, node := range s.nodes {
+		if node.addr.String() == addr.String() {
+			if s.update(node, err) {
+				s.rebuild()
+			}
+			return
+		}
+	}
+}
+
+func (s *MemcachedSelector) monitor() {
+	ticker := time.NewTicker(MEMCACHED_HEALTH_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		changed := false
+		for _, node := range s.nodes {
+			if s.update(node, s.check(node.addr)) {
+				changed = true
+			}
+		}
+		if changed {
+			s.rebuild()
+		}
+	}
+}
+
+// update records the result of a health check or a request, and reports
+// whether the node was ejected or brought back.
+func (s *MemcachedSelector) update(node *memcachedNode, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		node.failures = 0
+		if !node.healthy {
+			s.log.Infof("Memcached node %s is back", node.addr)
+			node.healthy = true
+			return true
+		}
+		return false
+	}
+	node.failures++
+	if node.healthy && node.failures >= MEMCACHED_EJECT_FAILURES {
+		s.log.Errorf("Ejecting memcached node %s: %s", node.addr, err)
+		node.healthy = false
+		return true
+	}
+	return false
+}
+
+func (s *MemcachedSelector) check(addr net.Addr) error {
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), s.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return fmt.Errorf("memcache: unexpected response to version: %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func (s *MemcachedSelector) rebuild() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ring := make([]ringPoint, 0, len(s.nodes)*MEMCACHED_RING_REPLICAS)
+	for _, node := range s.nodes {
+		if !node.healthy {
+			continue
+		}
+		for i := 0; i < MEMCACHED_RING_REPLICAS; i++ {
+			ring = append(ring, ringPoint{
+				hash: ringHash(node.addr.String() + "-" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	s.ring = ring
+}
+
+// ringHash is MD5 based like ketama, which spreads keys over the nodes much
+// more evenly than CRC32.
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// resolveMemcachedAddr accepts the same addresses as memcache.New, where
+// anything with a slash is a Unix socket.
+func resolveMemcachedAddr(addr string) (net.Addr, error) {
+	if strings.Contains(addr, "/") {
+		return net.ResolveUnixAddr("unix", addr)
+	}
+	return net.ResolveTCPAddr("tcp", addr)
+}
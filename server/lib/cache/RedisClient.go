@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"gbf-proxy/lib/marshaler"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const REDIS_SCAN_COUNT = 100
+
+// Errors of the connection pool, which go-redis doesn't export
+var redisPoolErrors = map[string]bool{
+	"redis: client is closed":        true,
+	"redis: connection pool timeout": true,
+}
+
+type RedisClient struct {
+	*redis.Client
+	marshaler.Marshaler
+	stats statsCounter
+}
+
+var _ Client = (*RedisClient)(nil)
+
+var redisPatternReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`?`, `\?`,
+	`[`, `\[`,
+	`]`, `\]`,
+)
+
+func NewRedisClient(rc *redis.Client, m marshaler.Marshaler) *RedisClient {
+	return &RedisClient{
+		Client:    rc,
+		Marshaler: m,
+	}
+}
+
+func (c *RedisClient) Get(ctx context.Context, key string, value interface{}) error {
+	return c.stats.get(c.get(ctx, key, value))
+}
+
+func (c *RedisClient) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	requested := len(values)
+	err := c.getMulti(ctx, values)
+	return c.stats.getMulti(requested, len(values), err)
+}
+
+func (c *RedisClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.stats.set(c.set(ctx, key, value, ttl))
+}
+
+func (c *RedisClient) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	ok, err := c.Client.WithContext(ctx).Expire(key, expiration(ttl)).Result()
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+func (c *RedisClient) Delete(ctx context.Context, key string) error {
+	n, err := c.Client.WithContext(ctx).Del(key).Result()
+	return c.stats.delete(int(n), err)
+}
+
+func (c *RedisClient) DeletePrefix(ctx context.Context, prefix string) error {
+	keys, err := c.Keys(ctx, prefix)
+	if err != nil {
+		return c.stats.delete(0, err)
+	}
+	deleted := 0
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > REDIS_SCAN_COUNT {
+			batch = batch[:REDIS_SCAN_COUNT]
+		}
+		keys = keys[len(batch):]
+		n, err := c.Client.WithContext(ctx).Del(batch...).Result()
+		deleted += int(n)
+		if err != nil {
+			return c.stats.delete(deleted, err)
+		}
+	}
+	return c.stats.delete(deleted, nil)
+}
+
+func (c *RedisClient) Stats() Stats {
+	return c.stats.stats()
+}
+
+func (c *RedisClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := c.Client.WithContext(ctx).TTL(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// Redis reports -2 for missing keys and -1 for keys without expiration
+	if ttl == -2*time.Second {
+		return 0, ErrCacheMiss
+	}
+	return ttl, nil
+}
+
+func (c *RedisClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	match := redisPatternReplacer.Replace(prefix) + "*"
+	keys := make([]string, 0)
+	cursor := uint64(0)
+	for {
+		result, next, err := c.Client.WithContext(ctx).Scan(cursor, match, REDIS_SCAN_COUNT).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, result...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+func (c *RedisClient) get(ctx context.Context, key string, value interface{}) error {
+	b, err := c.Client.WithContext(ctx).Get(key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return ErrCacheMiss
+		}
+		return err
+	}
+	if err := c.Marshaler.Unmarshal(b, value); err != nil {
+		c.Client.WithContext(ctx).Del(key)
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+func (c *RedisClient) getMulti(ctx context.Context, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	if len(keys) <= 0 {
+		return nil
+	}
+	results, err := c.Client.WithContext(ctx).MGet(keys...).Result()
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		s, ok := results[i].(string)
+		if !ok {
+			delete(values, key)
+			continue
+		}
+		if err := c.Marshaler.Unmarshal([]byte(s), values[key]); err != nil {
+			c.Client.WithContext(ctx).Del(key)
+			delete(values, key)
+		}
+	}
+	return nil
+}
+
+func (c *RedisClient) set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	b, err := c.Marshaler.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.Client.WithContext(ctx).Set(key, b, expiration(ttl)).Err()
+}
+
+// redisUnavailable reports whether an error comes from failing to reach the
+// server rather than from the command.
+func redisUnavailable(err error) bool {
+	return redisPoolErrors[err.Error()]
+}
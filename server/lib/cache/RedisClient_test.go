@@ -0,0 +1,429 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gbf-proxy/lib/marshaler"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeRedis speaks just enough of the Redis protocol for RedisClient.
+type fakeRedis struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		listener: l,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		reply := s.exec(args)
+		s.mutex.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := s.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkString(v)
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if v, ok := s.get(key); ok {
+				reply += bulkString(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "SET":
+		s.values[args[1]] = args[2]
+		delete(s.expires, args[1])
+		if len(args) >= 5 {
+			n, _ := strconv.ParseInt(args[4], 10, 64)
+			unit := time.Second
+			if strings.ToUpper(args[3]) == "PX" {
+				unit = time.Millisecond
+			}
+			s.expires[args[1]] = time.Now().Add(time.Duration(n) * unit)
+		}
+		return "+OK\r\n"
+	case "EXPIRE":
+		if _, ok := s.get(args[1]); !ok {
+			return ":0\r\n"
+		}
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		s.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+		return ":1\r\n"
+	case "TTL":
+		if _, ok := s.get(args[1]); !ok {
+			return ":-2\r\n"
+		}
+		expiresAt, ok := s.expires[args[1]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", int64(time.Until(expiresAt)/time.Second))
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(key); ok {
+				delete(s.values, key)
+				delete(s.expires, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SCAN":
+		return s.scan(args)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func (s *fakeRedis) get(key string) (string, bool) {
+	v, ok := s.values[key]
+	if !ok {
+		return "", false
+	}
+	if expiresAt, ok := s.expires[key]; ok && !time.Now().Before(expiresAt) {
+		delete(s.values, key)
+		delete(s.expires, key)
+		return "", false
+	}
+	return v, true
+}
+
+// scan pages through the keys in order, using the index of the next key as
+// the cursor.
+func (s *fakeRedis) scan(args []string) string {
+	cursor, _ := strconv.Atoi(args[1])
+	match := "*"
+	count := 10
+	for i := 2; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	end := cursor + count
+	next := end
+	if end >= len(keys) {
+		end = len(keys)
+		next = 0
+	}
+	found := make([]string, 0)
+	for _, key := range keys[cursor:end] {
+		if redisMatch(match, key) {
+			if _, ok := s.get(key); ok {
+				found = append(found, key)
+			}
+		}
+	}
+	reply := "*2\r\n" + bulkString(strconv.Itoa(next)) + fmt.Sprintf("*%d\r\n", len(found))
+	for _, key := range found {
+		reply += bulkString(key)
+	}
+	return reply
+}
+
+func (s *fakeRedis) setRaw(key string, value string, expiresAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = value
+	if expiresAt.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = expiresAt
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// redisMatch supports the parts of Redis patterns that RedisClient uses,
+// where * also matches slashes unlike path.Match.
+func redisMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if redisMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) <= 0 {
+				return false
+			}
+		case '\\':
+			pattern = pattern[1:]
+			fallthrough
+		default:
+			if len(s) <= 0 || len(pattern) <= 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) <= 0
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+type testValue struct {
+	Name string
+}
+
+func newTestRedisClient(t *testing.T) (*RedisClient, *fakeRedis) {
+	s := newFakeRedis(t)
+	rc := redis.NewClient(&redis.Options{
+		Addr: s.listener.Addr().String(),
+	})
+	return NewRedisClient(rc, marshaler.NewMsgpackMarshaler()), s
+}
+
+func TestRedisClientGetSet(t *testing.T) {
+	c, s := newTestRedisClient(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := c.Get(ctx, "missing", &testValue{}); err != ErrCacheMiss {
+		t.Fatalf("Get of a missing key returned %v, expected ErrCacheMiss", err)
+	}
+	if err := c.Set(ctx, "a", &testValue{Name: "a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	v := &testValue{}
+	if err := c.Get(ctx, "a", v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "a" {
+		t.Fatalf("Get returned %q, expected %q", v.Name, "a")
+	}
+
+	s.setRaw("undecodable", "\xc1", time.Time{})
+	if err := c.Get(ctx, "undecodable", &testValue{}); err != ErrCacheMiss {
+		t.Fatalf("Get of an undecodable entry returned %v, expected ErrCacheMiss", err)
+	}
+	if _, err := c.TTL(ctx, "undecodable"); err != ErrCacheMiss {
+		t.Fatalf("Undecodable entry was not evicted")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Sets != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestRedisClientGetMulti(t *testing.T) {
+	c, s := newTestRedisClient(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	c.Set(ctx, "a", &testValue{Name: "a"}, time.Minute)
+	c.Set(ctx, "b", &testValue{Name: "b"}, time.Minute)
+	s.setRaw("expired", "\x81\xa4Name\xa1x", time.Now().Add(-time.Second))
+	values := map[string]interface{}{
+		"a":       &testValue{},
+		"b":       &testValue{},
+		"expired": &testValue{},
+		"missing": &testValue{},
+	}
+	if err := c.GetMulti(ctx, values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("GetMulti found %d entries, expected 2", len(values))
+	}
+	if values["a"].(*testValue).Name != "a" || values["b"].(*testValue).Name != "b" {
+		t.Fatalf("GetMulti returned the wrong values")
+	}
+	if err := c.GetMulti(ctx, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisClientTouchAndTTL(t *testing.T) {
+	c, s := newTestRedisClient(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := c.Touch(ctx, "missing", time.Minute); err != ErrCacheMiss {
+		t.Fatalf("Touch of a missing key returned %v, expected ErrCacheMiss", err)
+	}
+	if _, err := c.TTL(ctx, "missing"); err != ErrCacheMiss {
+		t.Fatalf("TTL of a missing key returned %v, expected ErrCacheMiss", err)
+	}
+
+	c.Set(ctx, "a", &testValue{Name: "a"}, time.Minute)
+	if ttl, err := c.TTL(ctx, "a"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("TTL returned %v, %v", ttl, err)
+	}
+	if err := c.Touch(ctx, "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.TTL(ctx, "a"); err != nil || ttl <= time.Minute {
+		t.Fatalf("TTL after Touch returned %v, %v", ttl, err)
+	}
+
+	// Entries are always stored with an expiration, falling back to the
+	// default one
+	c.Set(ctx, "b", &testValue{Name: "b"}, 0)
+	if ttl, err := c.TTL(ctx, "b"); err != nil || ttl <= time.Hour || ttl > DEFAULT_EXPIRATION {
+		t.Fatalf("TTL of an entry without TTL returned %v, %v", ttl, err)
+	}
+
+	s.setRaw("persistent", "\x81\xa4Name\xa1p", time.Time{})
+	if ttl, err := c.TTL(ctx, "persistent"); err != nil || ttl != -time.Second {
+		t.Fatalf("TTL of an entry without expiration returned %v, %v", ttl, err)
+	}
+}
+
+func TestRedisClientDelete(t *testing.T) {
+	c, s := newTestRedisClient(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	c.Set(ctx, "a", &testValue{Name: "a"}, time.Minute)
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, "a", &testValue{}); err != ErrCacheMiss {
+		t.Fatalf("Get of a deleted key returned %v, expected ErrCacheMiss", err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Delete of a missing key returned %v", err)
+	}
+	if deletes := c.Stats().Deletes; deletes != 1 {
+		t.Fatalf("Counted %d deletes, expected 1", deletes)
+	}
+}
+
+func TestRedisClientKeysAndDeletePrefix(t *testing.T) {
+	c, s := newTestRedisClient(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	// More keys than REDIS_SCAN_COUNT, so that both SCAN and DEL page
+	for i := 0; i < REDIS_SCAN_COUNT+50; i++ {
+		c.Set(ctx, fmt.Sprintf("chunk:%03d", i), &testValue{}, time.Minute)
+	}
+	c.Set(ctx, "/assets/a*b", &testValue{}, time.Minute)
+	c.Set(ctx, "/assets/ab", &testValue{}, time.Minute)
+
+	keys, err := c.Keys(ctx, "chunk:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != REDIS_SCAN_COUNT+50 {
+		t.Fatalf("Keys found %d keys, expected %d", len(keys), REDIS_SCAN_COUNT+50)
+	}
+	keys, err = c.Keys(ctx, "/assets/a*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "/assets/a*b" {
+		t.Fatalf("Keys matched %v, expected the prefix to be taken literally", keys)
+	}
+
+	if err := c.DeletePrefix(ctx, "chunk:"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = c.Keys(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "/assets/a*b" || keys[1] != "/assets/ab" {
+		t.Fatalf("DeletePrefix left %v", keys)
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"gbf-proxy/lib/metrics"
+	"sync/atomic"
+)
+
+type Stats struct {
+	Hits    int64
+	Misses  int64
+	Sets    int64
+	Deletes int64
+	Errors  int64
+}
+
+type statsCounter struct {
+	hits    int64
+	misses  int64
+	sets    int64
+	deletes int64
+	errors  int64
+}
+
+func RegisterStats(r *metrics.Registry, name string, c Client) {
+	r.Gauge(name+".hits", func() int64 { return c.Stats().Hits })
+	r.Gauge(name+".misses", func() int64 { return c.Stats().Misses })
+	r.Gauge(name+".sets", func() int64 { return c.Stats().Sets })
+	r.Gauge(name+".deletes", func() int64 { return c.Stats().Deletes })
+	r.Gauge(name+".errors", func() int64 { return c.Stats().Errors })
+}
+
+func (s *statsCounter) get(err error) error {
+	if err == nil {
+		atomic.AddInt64(&s.hits, 1)
+	} else if err == ErrCacheMiss {
+		atomic.AddInt64(&s.misses, 1)
+	} else {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	return err
+}
+
+func (s *statsCounter) getMulti(requested int, found int, err error) error {
+	if err != nil {
+		atomic.AddInt64(&s.errors, 1)
+		return err
+	}
+	atomic.AddInt64(&s.hits, int64(found))
+	atomic.AddInt64(&s.misses, int64(requested-found))
+	return nil
+}
+
+func (s *statsCounter) set(err error) error {
+	if err == nil {
+		atomic.AddInt64(&s.sets, 1)
+	} else {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	return err
+}
+
+func (s *statsCounter) delete(n int, err error) error {
+	if err == nil {
+		atomic.AddInt64(&s.deletes, int64(n))
+	} else if err != ErrNotSupported {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	return err
+}
+
+func (s *statsCounter) stats() Stats {
+	return Stats{
+		Hits:    atomic.LoadInt64(&s.hits),
+		Misses:  atomic.LoadInt64(&s.misses),
+		Sets:    atomic.LoadInt64(&s.sets),
+		Deletes: atomic.LoadInt64(&s.deletes),
+		Errors:  atomic.LoadInt64(&s.errors),
+	}
+}
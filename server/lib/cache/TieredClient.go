@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"gbf-proxy/lib/metrics"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries are kept in memory for no longer than this, so that changes made
+// to the backend by other processes are picked up eventually.
+const TIERED_MEMORY_MAX_TTL = time.Minute
+
+type Sizer interface {
+	Size() int64
+}
+
+type TieredClient struct {
+	backend  Client
+	maxBytes int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+
+	memoryHits    *metrics.Counter
+	memoryMisses  *metrics.Counter
+	backendHits   *metrics.Counter
+	backendMisses *metrics.Counter
+}
+
+type memoryEntry struct {
+	key       string
+	value     reflect.Value
+	size      int64
+	expiresAt time.Time
+}
+
+var _ Client = (*TieredClient)(nil)
+
+func NewTieredClient(backend Client, maxBytes int64) *TieredClient {
+	registry := metrics.DefaultRegistry
+	c := &TieredClient{
+		backend:       backend,
+		maxBytes:      maxBytes,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		memoryHits:    registry.Counter("cache.memory.hits"),
+		memoryMisses:  registry.Counter("cache.memory.misses"),
+		backendHits:   registry.Counter("cache.backend.hits"),
+		backendMisses: registry.Counter("cache.backend.misses"),
+	}
+	registry.Gauge("cache.memory.bytes", c.Bytes)
+	registry.Gauge("cache.memory.items", c.Items)
+	return c
+}
+
+func (c *TieredClient) Get(ctx context.Context, key string, value interface{}) error {
+	if c.getMemory(key, value) {
+		c.memoryHits.Inc()
+		return nil
+	}
+	c.memoryMisses.Inc()
+
+	err := c.backend.Get(ctx, key, value)
+	if err != nil {
+		if err == ErrCacheMiss {
+			c.backendMisses.Inc()
+		}
+		return err
+	}
+	c.backendHits.Inc()
+	c.setMemory(key, value, 0)
+	return nil
+}
+
+func (c *TieredClient) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	remaining := make(map[string]interface{})
+	for key, value := range values {
+		if c.getMemory(key, value) {
+			c.memoryHits.Inc()
+		} else {
+			c.memoryMisses.Inc()
+			remaining[key] = value
+		}
+	}
+	if len(remaining) <= 0 {
+		return nil
+	}
+
+	missed := make(map[string]bool, len(remaining))
+	for key := range remaining {
+		missed[key] = true
+	}
+	err := c.backend.GetMulti(ctx, remaining)
+	if err != nil {
+		return err
+	}
+	for key := range remaining {
+		delete(missed, key)
+	}
+	c.backendHits.Add(int64(len(remaining)))
+	c.backendMisses.Add(int64(len(missed)))
+	for key, value := range remaining {
+		c.setMemory(key, value, 0)
+	}
+	for key := range missed {
+		delete(values, key)
+	}
+	return nil
+}
+
+func (c *TieredClient) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	err := c.backend.Set(ctx, key, value, ttl)
+	if err != nil {
+		c.remove(key)
+		return err
+	}
+	c.setMemory(key, value, ttl)
+	return nil
+}
+
+func (c *TieredClient) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	err := c.backend.Touch(ctx, key, ttl)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[key]; ok {
+		if err != nil {
+			c.removeElement(el)
+		} else {
+			el.Value.(*memoryEntry).expiresAt = memoryExpiration(ttl)
+		}
+	}
+	return err
+}
+
+func (c *TieredClient) Delete(ctx context.Context, key string) error {
+	c.remove(key)
+	return c.backend.Delete(ctx, key)
+}
+
+func (c *TieredClient) DeletePrefix(ctx context.Context, prefix string) error {
+	c.mutex.Lock()
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+		}
+	}
+	c.mutex.Unlock()
+	return c.backend.DeletePrefix(ctx, prefix)
+}
+
+func (c *TieredClient) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := c.backend.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		found[key] = true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if !found[key] && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *TieredClient) Stats() Stats {
+	stats := c.backend.Stats()
+	stats.Hits += c.memoryHits.Value()
+	return stats
+}
+
+func (c *TieredClient) Close() error {
+	return c.backend.Close()
+}
+
+func (c *TieredClient) Bytes() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.bytes
+}
+
+func (c *TieredClient) Items() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int64(len(c.entries))
+}
+
+func (c *TieredClient) getMemory(key string, value interface{}) bool {
+	target := reflect.ValueOf(value)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*memoryEntry)
+	if !time.Now().Before(e.expiresAt) {
+		c.removeElement(el)
+		return false
+	}
+	if e.value.Type() != target.Elem().Type() {
+		return false
+	}
+	target.Elem().Set(e.value)
+	c.lru.MoveToFront(el)
+	return true
+}
+
+// setMemory keeps a copy of the value for the given TTL, or for as long as
+// the memory tier allows if it is unknown.
+func (c *TieredClient) setMemory(key string, value interface{}, ttl time.Duration) {
+	sizer, ok := value.(Sizer)
+	source := reflect.ValueOf(value)
+	if !ok || source.Kind() != reflect.Ptr || source.IsNil() {
+		c.remove(key)
+		return
+	}
+	size := sizer.Size()
+	if size > c.maxBytes {
+		c.remove(key)
+		return
+	}
+
+	copied := reflect.New(source.Elem().Type()).Elem()
+	copied.Set(source.Elem())
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{
+		key:       key,
+		value:     copied,
+		size:      size,
+		expiresAt: memoryExpiration(ttl),
+	})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *TieredClient) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *TieredClient) removeElement(el *list.Element) {
+	e := el.Value.(*memoryEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+func memoryExpiration(ttl time.Duration) time.Time {
+	if ttl <= 0 || ttl > TIERED_MEMORY_MAX_TTL {
+		ttl = TIERED_MEMORY_MAX_TTL
+	}
+	return time.Now().Add(ttl)
+}
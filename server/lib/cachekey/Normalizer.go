@@ -0,0 +1,201 @@
+package cachekey
+
+import (
+	"fmt"
+	"gbf-proxy/lib/glob"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type Rule struct {
+	Path string   `yaml:"path"`
+	Drop []string `yaml:"drop"`
+	Keep []string `yaml:"keep"`
+}
+
+type Config struct {
+	IncludeHost       bool   `yaml:"include_host"`
+	SortQuery         bool   `yaml:"sort_query"`
+	NormalizeEncoding bool   `yaml:"normalize_encoding"`
+	Rules             []Rule `yaml:"rules"`
+}
+
+type Normalizer struct {
+	config Config
+	rules  []*compiledRule
+}
+
+type compiledRule struct {
+	path *glob.Glob
+	drop []*glob.Glob
+	keep []*glob.Glob
+}
+
+type queryParam struct {
+	raw      string
+	name     string
+	value    string
+	hasValue bool
+}
+
+// DefaultNormalizer keys assets by their path and query as requested.
+var DefaultNormalizer = &Normalizer{}
+
+func NewNormalizer(config Config) (*Normalizer, error) {
+	rules := make([]*compiledRule, len(config.Rules))
+	for i, rule := range config.Rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = cr
+	}
+	return &Normalizer{
+		config: config,
+		rules:  rules,
+	}, nil
+}
+
+func (n *Normalizer) Key(u *url.URL) string {
+	key := u.Path
+	if n.config.IncludeHost {
+		key = hostKey(u) + key
+	}
+	query := n.query(u)
+	if query == "" {
+		return key
+	}
+	return fmt.Sprintf("%s?%s", key, query)
+}
+
+func (n *Normalizer) query(u *url.URL) string {
+	rule := n.match(u.Path)
+	if rule == nil && !n.config.SortQuery && !n.config.NormalizeEncoding {
+		return u.RawQuery
+	}
+
+	params := parseQuery(u.RawQuery)
+	if rule != nil {
+		params = rule.filter(params)
+	}
+	if n.config.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			if params[i].name != params[j].name {
+				return params[i].name < params[j].name
+			}
+			return params[i].value < params[j].value
+		})
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		if !n.config.NormalizeEncoding {
+			parts[i] = p.raw
+			continue
+		}
+		parts[i] = url.QueryEscape(p.name)
+		if p.hasValue {
+			parts[i] += "=" + url.QueryEscape(p.value)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (n *Normalizer) match(path string) *compiledRule {
+	for _, rule := range n.rules {
+		if rule.path.Match(path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *compiledRule) filter(params []queryParam) []queryParam {
+	result := make([]queryParam, 0, len(params))
+	for _, p := range params {
+		if len(r.keep) > 0 && !matchAny(r.keep, p.name) {
+			continue
+		}
+		if matchAny(r.drop, p.name) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	path, err := glob.Compile(rule.Path, '/')
+	if err != nil {
+		return nil, err
+	}
+	drop, err := compileNames(rule.Drop)
+	if err != nil {
+		return nil, err
+	}
+	keep, err := compileNames(rule.Keep)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledRule{
+		path: path,
+		drop: drop,
+		keep: keep,
+	}, nil
+}
+
+func compileNames(patterns []string) ([]*glob.Glob, error) {
+	globs := make([]*glob.Glob, len(patterns))
+	for i, pattern := range patterns {
+		g, err := glob.Compile(pattern, '&')
+		if err != nil {
+			return nil, err
+		}
+		globs[i] = g
+	}
+	return globs, nil
+}
+
+func matchAny(globs []*glob.Glob, s string) bool {
+	for _, g := range globs {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQuery(rawQuery string) []queryParam {
+	params := make([]queryParam, 0)
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		p := queryParam{raw: part}
+		name := part
+		if idx := strings.Index(part, "="); idx >= 0 {
+			name, p.value, p.hasValue = part[:idx], part[idx+1:], true
+		}
+		p.name = unescape(name)
+		p.value = unescape(p.value)
+		params = append(params, p)
+	}
+	return params
+}
+
+func unescape(s string) string {
+	unescaped, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
+
+func hostKey(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" || (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		return host
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,114 @@
+package cachepolicy
+
+import (
+	"gbf-proxy/lib/glob"
+	"mime"
+	"strings"
+	"time"
+)
+
+type Rule struct {
+	Path        string        `yaml:"path"`
+	Host        string        `yaml:"host"`
+	ContentType string        `yaml:"content_type"`
+	TTL         time.Duration `yaml:"ttl"`
+	Cache       *bool         `yaml:"cache"`
+	Sliding     bool          `yaml:"sliding"`
+}
+
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Decision is what the first matching rule says about a response. A zero
+// TTL leaves the lifetime given by the upstream headers in place.
+type Decision struct {
+	Cache   bool
+	TTL     time.Duration
+	Sliding bool
+}
+
+type Policy struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	path        *glob.Glob
+	host        *glob.Glob
+	contentType *glob.Glob
+	decision    Decision
+}
+
+// DefaultPolicy caches every response for as long as upstream allows.
+var DefaultPolicy = &Policy{}
+
+func NewPolicy(config Config) (*Policy, error) {
+	rules := make([]*compiledRule, len(config.Rules))
+	for i, rule := range config.Rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = cr
+	}
+	return &Policy{
+		rules: rules,
+	}, nil
+}
+
+func (p *Policy) Match(host string, path string, contentType string) Decision {
+	host = strings.ToLower(host)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	} else {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, rule := range p.rules {
+		if rule.match(host, path, contentType) {
+			return rule.decision
+		}
+	}
+	return Decision{
+		Cache: true,
+	}
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	cr := &compiledRule{
+		decision: Decision{
+			Cache:   rule.Cache == nil || *rule.Cache,
+			TTL:     rule.TTL,
+			Sliding: rule.Sliding,
+		},
+	}
+	var err error
+	if rule.Path != "" {
+		if cr.path, err = glob.Compile(rule.Path, '/'); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Host != "" {
+		if cr.host, err = glob.Compile(strings.ToLower(rule.Host), '.'); err != nil {
+			return nil, err
+		}
+	}
+	if rule.ContentType != "" {
+		if cr.contentType, err = glob.Compile(strings.ToLower(rule.ContentType), '/'); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+func (r *compiledRule) match(host string, path string, contentType string) bool {
+	if r.path != nil && !r.path.Match(path) {
+		return false
+	}
+	if r.host != nil && !r.host.Match(host) {
+		return false
+	}
+	if r.contentType != nil && !r.contentType.Match(contentType) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	CODEC_NONE   = "none"
+	CODEC_GZIP   = "gzip"
+	CODEC_SNAPPY = "snappy"
+)
+
+type Codec interface {
+	Name() string
+	// ContentEncoding is the HTTP content coding that the compressed bytes
+	// can be served as, or empty if clients can't decode them.
+	ContentEncoding() string
+	NewWriter(w io.Writer) io.WriteCloser
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type gzipCodec struct{}
+
+type snappyCodec struct{}
+
+var codecs = map[string]Codec{
+	CODEC_GZIP:   gzipCodec{},
+	CODEC_SNAPPY: snappyCodec{},
+}
+
+// Get returns the codec with the given name, or nil for "none" and "".
+func Get(name string) (Codec, error) {
+	if name == "" || name == CODEC_NONE {
+		return nil, nil
+	}
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unknown compression codec: %s", name)
+}
+
+func (gzipCodec) Name() string {
+	return CODEC_GZIP
+}
+
+func (gzipCodec) ContentEncoding() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (snappyCodec) Name() string {
+	return CODEC_SNAPPY
+}
+
+func (snappyCodec) ContentEncoding() string {
+	return ""
+}
+
+func (snappyCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return snappy.NewBufferedWriter(w)
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
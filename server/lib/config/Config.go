@@ -0,0 +1,33 @@
+package config
+
+import (
+	"gbf-proxy/lib/cachekey"
+	"gbf-proxy/lib/cachepolicy"
+	"gbf-proxy/lib/hostrules"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	CacheKeys   cachekey.Config    `yaml:"cache_keys"`
+	CachePolicy cachepolicy.Config `yaml:"cache_policy"`
+	// HostRules replace hostrules.DefaultRules when they are set
+	HostRules []hostrules.Rule `yaml:"host_rules"`
+}
+
+func Load(path string) (*Config, error) {
+	c := &Config{}
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,74 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// StreamConn lets a reader and a writer be used where a net.Conn is
+// expected, such as underneath a TLS server. Addresses and deadlines are
+// taken from the writer when it is a connection itself. Closing it leaves
+// the underlying streams open to whoever handed them over.
+type StreamConn struct {
+	io.Reader
+	io.Writer
+}
+
+type streamAddr struct{}
+
+var _ net.Conn = (*StreamConn)(nil)
+
+func NewStreamConn(r io.Reader, w io.Writer) *StreamConn {
+	return &StreamConn{
+		Reader: r,
+		Writer: w,
+	}
+}
+
+func (c *StreamConn) Close() error {
+	return nil
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	if conn, ok := c.Writer.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return streamAddr{}
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Writer.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return streamAddr{}
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	if conn, ok := c.Writer.(net.Conn); ok {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := c.Writer.(net.Conn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := c.Writer.(net.Conn); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (streamAddr) Network() string {
+	return "stream"
+}
+
+func (streamAddr) String() string {
+	return "stream"
+}
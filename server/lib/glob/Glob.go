@@ -0,0 +1,96 @@
+package glob
+
+import (
+	"regexp"
+	"strings"
+)
+
+type Glob struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compile supports "*" and "?" within a single segment separated by the
+// given separator, "**" across segments, and "[...]" character classes.
+func Compile(pattern string, separator rune) (*Glob, error) {
+	sep := regexp.QuoteMeta(string(separator))
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^" + sep + "]*")
+			}
+		case '?':
+			sb.WriteString("[^" + sep + "]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				sb.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, err
+	}
+	return &Glob{
+		pattern: pattern,
+		re:      re,
+	}, nil
+}
+
+func MustCompile(pattern string, separator rune) *Glob {
+	g, err := Compile(pattern, separator)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g *Glob) Match(s string) bool {
+	return g.re.MatchString(s)
+}
+
+func (g *Glob) String() string {
+	return g.pattern
+}
+
+// Prefix returns the literal part of the pattern before its first wildcard.
+func (g *Glob) Prefix() string {
+	var sb strings.Builder
+	for i := 0; i < len(g.pattern); i++ {
+		ch := g.pattern[i]
+		switch ch {
+		case '*', '?', '[':
+			return sb.String()
+		case '\\':
+			if i+1 < len(g.pattern) {
+				i++
+			}
+		}
+		sb.WriteByte(g.pattern[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,201 @@
+package hostrules
+
+import (
+	"fmt"
+	"gbf-proxy/lib/glob"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ACTION_ALLOW     = "allow"
+	ACTION_INTERCEPT = "intercept"
+	ACTION_CACHE     = "cache"
+	ACTION_DENY      = "deny"
+
+	HOST_RULES_MEMO_SIZE = 4096
+)
+
+// Rule applies its action to the hosts that match all of the patterns it
+// sets. Hosts are compared in lower case.
+type Rule struct {
+	Action string `yaml:"action"`
+	Exact  string `yaml:"exact"`
+	Suffix string `yaml:"suffix"`
+	Glob   string `yaml:"glob"`
+	Regex  string `yaml:"regex"`
+	Port   int    `yaml:"port"`
+}
+
+// Decision combines the actions of every rule that matches a host. A
+// matching deny rule overrides all of the others.
+type Decision struct {
+	Allow     bool
+	Intercept bool
+	Cache     bool
+}
+
+// DefaultRules allow the game hosts through the proxy, and intercept and
+// cache requests to the asset hosts.
+var DefaultRules = []Rule{
+	{Action: ACTION_ALLOW, Glob: "game**.granbluefantasy.jp"},
+	{Action: ACTION_ALLOW, Glob: "gbf.game**.mbga.jp"},
+	{Action: ACTION_ALLOW, Suffix: ".mobage.jp"},
+	{Action: ACTION_INTERCEPT, Glob: "game-a**"},
+	{Action: ACTION_INTERCEPT, Glob: "gbf.game-a**"},
+	{Action: ACTION_CACHE, Glob: "game-a**.granbluefantasy.jp"},
+	{Action: ACTION_CACHE, Glob: "gbf.game-a**.mbga.jp"},
+}
+
+// Engine evaluates host rules without locking. Rules are replaced as a
+// whole when they are reloaded, along with the decisions memoized for them.
+type Engine struct {
+	rules atomic.Value
+}
+
+type ruleSet struct {
+	rules []*compiledRule
+	memo  atomic.Value
+	size  int64
+}
+
+type compiledRule struct {
+	action string
+	exact  string
+	suffix string
+	glob   *glob.Glob
+	regex  *regexp.Regexp
+	port   string
+}
+
+// NewEngine compiles the given rules, or DefaultRules if they are nil.
+func NewEngine(rules []Rule) (*Engine, error) {
+	e := &Engine{}
+	if err := e.Reload(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func MustNewEngine(rules []Rule) *Engine {
+	e, err := NewEngine(rules)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *Engine) Reload(rules []Rule) error {
+	if rules == nil {
+		rules = DefaultRules
+	}
+	rs := &ruleSet{
+		rules: make([]*compiledRule, len(rules)),
+	}
+	for i, rule := range rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			return err
+		}
+		rs.rules[i] = cr
+	}
+	rs.memo.Store(&sync.Map{})
+	e.rules.Store(rs)
+	return nil
+}
+
+// Match evaluates the rules for a host and port, where the port may be
+// empty if it isn't known.
+func (e *Engine) Match(host string, port string) Decision {
+	rs := e.rules.Load().(*ruleSet)
+	host = strings.ToLower(host)
+	key := net.JoinHostPort(host, port)
+	memo := rs.memo.Load().(*sync.Map)
+	if d, ok := memo.Load(key); ok {
+		return d.(Decision)
+	}
+	d := rs.match(host, port)
+	// Rather than tracking which decisions are used the least, the memo is
+	// simply started over once it is full.
+	if atomic.AddInt64(&rs.size, 1) > HOST_RULES_MEMO_SIZE {
+		memo = &sync.Map{}
+		rs.memo.Store(memo)
+		atomic.StoreInt64(&rs.size, 1)
+	}
+	memo.Store(key, d)
+	return d
+}
+
+func (rs *ruleSet) match(host string, port string) Decision {
+	d := Decision{}
+	for _, rule := range rs.rules {
+		if !rule.match(host, port) {
+			continue
+		}
+		switch rule.action {
+		case ACTION_ALLOW:
+			d.Allow = true
+		case ACTION_INTERCEPT:
+			d.Intercept = true
+		case ACTION_CACHE:
+			d.Cache = true
+		case ACTION_DENY:
+			return Decision{}
+		}
+	}
+	return d
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	switch rule.Action {
+	case ACTION_ALLOW, ACTION_INTERCEPT, ACTION_CACHE, ACTION_DENY:
+	default:
+		return nil, fmt.Errorf("Unknown host rule action: %s", rule.Action)
+	}
+	if rule.Exact == "" && rule.Suffix == "" && rule.Glob == "" && rule.Regex == "" && rule.Port == 0 {
+		return nil, fmt.Errorf("Host rule for %s matches nothing", rule.Action)
+	}
+	cr := &compiledRule{
+		action: rule.Action,
+		exact:  strings.ToLower(rule.Exact),
+		suffix: strings.ToLower(rule.Suffix),
+	}
+	var err error
+	if rule.Glob != "" {
+		if cr.glob, err = glob.Compile(strings.ToLower(rule.Glob), '.'); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Regex != "" {
+		if cr.regex, err = regexp.Compile(rule.Regex); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Port != 0 {
+		cr.port = strconv.Itoa(rule.Port)
+	}
+	return cr, nil
+}
+
+func (r *compiledRule) match(host string, port string) bool {
+	if r.exact != "" && host != r.exact {
+		return false
+	}
+	if r.suffix != "" && !strings.HasSuffix(host, r.suffix) {
+		return false
+	}
+	if r.glob != nil && !r.glob.Match(host) {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(host) {
+		return false
+	}
+	if r.port != "" && port != r.port {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Range",
+	"Range",
+}
+
+func NotModified(req *http.Request, header http.Header) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if values, ok := req.Header["If-None-Match"]; ok {
+		return ETagMatches(strings.Join(values, ","), header.Get("ETag"))
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+func ETagMatches(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func NotModifiedHeader(header http.Header) http.Header {
+	result := make(http.Header)
+	for key, values := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			result[key] = values
+		}
+	}
+	for _, key := range notModifiedHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if values, ok := header[key]; ok {
+			result[key] = values
+		}
+	}
+	return result
+}
+
+func UnconditionalRequest(req *http.Request) *http.Request {
+	stripped := req.Clone(req.Context())
+	for _, key := range conditionalHeaders {
+		stripped.Header.Del(key)
+	}
+	return stripped
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func AcceptsEncoding(req *http.Request, coding string) bool {
+	accepted := false
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != coding && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			// An explicit entry for the coding takes precedence over "*"
+			if name == coding {
+				return q > 0
+			}
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+func Compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func WeakETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CacheControl map[string]string
+
+type Freshness struct {
+	Cacheable            bool
+	Lifetime             time.Duration
+	StaleWhileRevalidate time.Duration
+}
+
+func ParseCacheControl(header http.Header) CacheControl {
+	cc := make(CacheControl)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if idx := strings.Index(directive, "="); idx >= 0 {
+				name, arg = directive[:idx], strings.Trim(directive[idx+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(arg)
+		}
+	}
+	return cc
+}
+
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc CacheControl) Duration(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func ResponseFreshness(header http.Header, now time.Time, heuristic time.Duration) Freshness {
+	cc := ParseCacheControl(header)
+	if cc.Has("no-store") || cc.Has("private") {
+		return Freshness{}
+	}
+	f := Freshness{
+		Cacheable: true,
+		Lifetime:  heuristic,
+	}
+	if swr, ok := cc.Duration("stale-while-revalidate"); ok {
+		f.StaleWhileRevalidate = swr
+	}
+
+	if cc.Has("no-cache") {
+		f.Lifetime = 0
+	} else if lifetime, ok := cc.Duration("s-maxage"); ok {
+		f.Lifetime = lifetime
+	} else if lifetime, ok := cc.Duration("max-age"); ok {
+		f.Lifetime = lifetime
+	} else if value, ok := header["Expires"]; ok {
+		f.Lifetime = 0
+		expires, err := http.ParseTime(strings.Join(value, ""))
+		if err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			if expires.After(date) {
+				f.Lifetime = expires.Sub(date)
+			}
+		}
+	}
+	return f
+}
+
+func ResponseAge(header http.Header) time.Duration {
+	seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func HasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+func RevalidationRequest(req *http.Request, header http.Header) *http.Request {
+	revalidation := UnconditionalRequest(req)
+	if etag := header.Get("ETag"); etag != "" {
+		revalidation.Header.Set("If-None-Match", etag)
+	}
+	if lm := header.Get("Last-Modified"); lm != "" {
+		revalidation.Header.Set("If-Modified-Since", lm)
+	}
+	return revalidation
+}
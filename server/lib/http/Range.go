@@ -0,0 +1,106 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+var ErrRangeNotSatisfiable = errors.New("http: requested range not satisfiable")
+
+func ParseRange(s string, size int64) ([]ByteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, nil
+	}
+	ranges := make([]ByteRange, 0)
+	total := int64(0)
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		idx := strings.Index(spec, "-")
+		if idx < 0 {
+			return nil, nil
+		}
+		first, last := strings.TrimSpace(spec[:idx]), strings.TrimSpace(spec[idx+1:])
+		var r ByteRange
+		if first == "" {
+			// Suffix range, e.g. "-500" for the last 500 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			// Nothing can be taken from the end of an empty body
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = ByteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = ByteRange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.Length
+	}
+	if len(ranges) <= 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	if total > size {
+		// Overlapping ranges that add up to more than the whole body are
+		// served as the full body instead.
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+func RangeApplies(req *http.Request, header http.Header) bool {
+	if req.Method != "GET" || req.Header.Get("Range") == "" {
+		return false
+	}
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		etag := header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && lm.Equal(t)
+}
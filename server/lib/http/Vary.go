@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ParseVary returns the canonical names of the request headers listed in
+// the Vary header, or "*" if the response varies on more than headers.
+func ParseVary(header http.Header) []string {
+	seen := make(map[string]bool)
+	fields := make([]string, 0)
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if field == "*" {
+				return []string{"*"}
+			}
+			field = http.CanonicalHeaderKey(field)
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// VaryKey normalizes the values of the given request headers so that
+// requests that differ only in letter case, whitespace or the order of list
+// elements map to the same variant.
+func VaryKey(req *http.Request, fields []string) string {
+	var sb strings.Builder
+	for _, field := range fields {
+		elements := make([]string, 0)
+		for _, value := range req.Header[http.CanonicalHeaderKey(field)] {
+			for _, element := range strings.Split(value, ",") {
+				element = strings.ToLower(strings.TrimSpace(element))
+				if element != "" {
+					elements = append(elements, element)
+				}
+			}
+		}
+		sort.Strings(elements)
+		sb.WriteString(field)
+		sb.WriteString(":")
+		sb.WriteString(strings.Join(elements, ","))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func AddVary(header http.Header, field string) {
+	for _, value := range header["Vary"] {
+		for _, existing := range strings.Split(value, ",") {
+			existing = strings.TrimSpace(existing)
+			if existing == "*" || strings.EqualFold(existing, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
@@ -0,0 +1,130 @@
+package marshaler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// ENVELOPE_VERSION is the layout of the envelope itself, not of the
+	// values in it
+	ENVELOPE_VERSION     = 1
+	ENVELOPE_HEADER_SIZE = 15
+	// Values written without an envelope are taken to be of this schema
+	ENVELOPE_LEGACY_SCHEMA = 1
+
+	MARSHALER_MSGPACK = 1
+)
+
+// envelopeMagic starts with 0xc1, which msgpack never uses, so that values
+// written before the envelope existed can't be mistaken for one.
+var envelopeMagic = []byte{0xc1, 'G', 'B', 'F'}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[byte]Marshaler{
+		MARSHALER_MSGPACK: NewMsgpackMarshaler(),
+	}
+)
+
+// Register makes a marshaler available to decode the values that were
+// written with its ID.
+func Register(id byte, m Marshaler) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[id] = m
+}
+
+func Lookup(id byte) (Marshaler, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	m, ok := registry[id]
+	return m, ok
+}
+
+// Envelope describes how a value was encoded. Schema is the version of the
+// value's own format, as set by whoever stores it.
+type Envelope struct {
+	Version   byte
+	Marshaler byte
+	Schema    byte
+	CreatedAt time.Time
+}
+
+// EnvelopeMarshaler prefixes values with an envelope, and decodes them
+// with whichever registered marshaler wrote them. Values without an
+// envelope are handed to its own marshaler as they are. Values of another
+// schema are refused, so that changing the format of the values turns the
+// old ones into errors rather than into garbage.
+type EnvelopeMarshaler struct {
+	id        byte
+	schema    byte
+	marshaler Marshaler
+}
+
+var _ Marshaler = (*EnvelopeMarshaler)(nil)
+
+func NewEnvelopeMarshaler(id byte, schema byte) (*EnvelopeMarshaler, error) {
+	m, ok := Lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("marshaler: unknown marshaler %d", id)
+	}
+	return &EnvelopeMarshaler{
+		id:        id,
+		schema:    schema,
+		marshaler: m,
+	}, nil
+}
+
+func (m *EnvelopeMarshaler) Marshal(v interface{}) ([]byte, error) {
+	b, err := m.marshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, ENVELOPE_HEADER_SIZE, ENVELOPE_HEADER_SIZE+len(b))
+	copy(data, envelopeMagic)
+	data[4] = ENVELOPE_VERSION
+	data[5] = m.id
+	data[6] = m.schema
+	binary.BigEndian.PutUint64(data[7:15], uint64(time.Now().Unix()))
+	return append(data, b...), nil
+}
+
+func (m *EnvelopeMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		if m.schema != ENVELOPE_LEGACY_SCHEMA {
+			return fmt.Errorf("marshaler: unsupported schema %d", ENVELOPE_LEGACY_SCHEMA)
+		}
+		return m.marshaler.Unmarshal(data, v)
+	}
+	e, err := ReadEnvelope(data)
+	if err != nil {
+		return err
+	}
+	if e.Schema != m.schema {
+		return fmt.Errorf("marshaler: unsupported schema %d", e.Schema)
+	}
+	um, ok := Lookup(e.Marshaler)
+	if !ok {
+		return fmt.Errorf("marshaler: unknown marshaler %d", e.Marshaler)
+	}
+	return um.Unmarshal(data[ENVELOPE_HEADER_SIZE:], v)
+}
+
+func ReadEnvelope(data []byte) (Envelope, error) {
+	if len(data) < ENVELOPE_HEADER_SIZE || !bytes.HasPrefix(data, envelopeMagic) {
+		return Envelope{}, fmt.Errorf("marshaler: missing envelope")
+	}
+	if data[4] != ENVELOPE_VERSION {
+		return Envelope{}, fmt.Errorf("marshaler: unsupported envelope version %d", data[4])
+	}
+	return Envelope{
+		Version:   data[4],
+		Marshaler: data[5],
+		Schema:    data[6],
+		CreatedAt: time.Unix(int64(binary.BigEndian.Uint64(data[7:15])), 0),
+	}, nil
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import "sync/atomic"
+
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
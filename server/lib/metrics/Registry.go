@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+type Registry struct {
+	mutex    sync.RWMutex
+	counters map[string]*Counter
+	gauges   map[string]func() int64
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+		gauges:   make(map[string]func() int64),
+	}
+}
+
+func (r *Registry) Counter(name string) *Counter {
+	r.mutex.RLock()
+	c, ok := r.counters[name]
+	r.mutex.RUnlock()
+	if ok {
+		return c
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if c, ok := r.counters[name]; ok {
+		return c
+	}
+	c = &Counter{}
+	r.counters[name] = c
+	return c
+}
+
+func (r *Registry) Gauge(name string, fn func() int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.gauges[name] = fn
+}
+
+func (r *Registry) Snapshot() map[string]int64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	values := make(map[string]int64, len(r.counters)+len(r.gauges))
+	for name, c := range r.counters {
+		values[name] = c.Value()
+	}
+	for name, fn := range r.gauges {
+		values[name] = fn()
+	}
+	return values
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	values := r.Snapshot()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	written := int64(0)
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "%s %d\n", name, values[name])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,147 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MITM_LEAF_VALIDITY   = 7 * 24 * time.Hour
+	MITM_LEAF_RENEWAL    = time.Hour
+	MITM_CERT_CACHE_SIZE = 1024
+	// Clients that don't finish the handshake by then are dropped
+	MITM_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// Authority issues leaf certificates for the hosts whose TLS connections
+// are intercepted, signed by a CA that the clients have been told to trust.
+// Leaf certificates share a single key and are kept in memory until they
+// are about to expire.
+type Authority struct {
+	ca      *x509.Certificate
+	caKey   crypto.PrivateKey
+	leafKey *ecdsa.PrivateKey
+
+	mutex sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func LoadAuthority(certFile string, keyFile string) (*Authority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("Certificate %s is not a CA", certFile)
+	}
+	return NewAuthority(ca, pair.PrivateKey)
+}
+
+func NewAuthority(ca *x509.Certificate, caKey crypto.PrivateKey) (*Authority, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{
+		ca:      ca,
+		caKey:   caKey,
+		leafKey: leafKey,
+		certs:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Config is a server configuration that presents a certificate for the
+// given host. Clients asking for any other server name are refused, so that
+// a tunnel opened to an intercepted host can't be used to obtain
+// certificates for others.
+func (a *Authority) Config(host string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !strings.EqualFold(hello.ServerName, host) {
+				return nil, fmt.Errorf("Server name %s does not match %s", hello.ServerName, host)
+			}
+			return a.Certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+func (a *Authority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	renewAt := time.Now().Add(MITM_LEAF_RENEWAL)
+	a.mutex.Lock()
+	cert, ok := a.certs[host]
+	a.mutex.Unlock()
+	if ok && cert.Leaf.NotAfter.After(renewAt) {
+		return cert, nil
+	}
+
+	cert, err := a.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// Rather than tracking which certificates are used the least, the cache
+	// is simply started over once it is full.
+	if len(a.certs) >= MITM_CERT_CACHE_SIZE {
+		a.certs = make(map[string]*tls.Certificate)
+	}
+	a.certs[host] = cert
+	return cert, nil
+}
+
+func (a *Authority) issue(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(MITM_LEAF_VALIDITY)
+	if notAfter.After(a.ca.NotAfter) {
+		notAfter = a.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.ca, &a.leafKey.PublicKey, a.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.ca.Raw},
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/glob"
+	httplib "gbf-proxy/lib/http"
+	"gbf-proxy/lib/logger"
+	"gbf-proxy/lib/metrics"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type AdminHandler struct {
+	version string
+	token   string
+	cache   *CacheHandler
+}
+
+type cacheEntryInfo struct {
+	Key        string      `json:"key"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Size       int64       `json:"size"`
+	StoredSize int64       `json:"stored_size"`
+	Encoding   string      `json:"encoding,omitempty"`
+	Vary       []string    `json:"vary,omitempty"`
+	BodyHash   string      `json:"body_hash,omitempty"`
+	Negative   bool        `json:"negative,omitempty"`
+	Chunks     int         `json:"chunks"`
+	StoredAt   time.Time   `json:"stored_at"`
+	Age        int64       `json:"age"`
+	TTL        int64       `json:"ttl"`
+	Fresh      bool        `json:"fresh"`
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+var _ StreamForwarder = (*AdminHandler)(nil)
+var _ RequestHandler = (*AdminHandler)(nil)
+
+func NewAdminHandler(version string, token string, ch *CacheHandler) *AdminHandler {
+	return &AdminHandler{
+		version: version,
+		token:   token,
+		cache:   ch,
+	}
+}
+
+func (h *AdminHandler) Forward(r io.Reader, w io.Writer) error {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	req = sanitizeRequest(req)
+	defer req.Body.Close()
+	res, err := h.HandleRequest(req, RequestContext{
+		Logger: logger.DefaultLogger,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return res.Write(w)
+}
+
+func (h *AdminHandler) HandleRequest(req *http.Request, ctx RequestContext) (*http.Response, error) {
+	if !h.authorized(req) {
+		ctx.Logger.Info("Denying admin request:", requestToString(req))
+		return h.errorResponse(req, 401, "401 Unauthorized", "Invalid or missing admin token"), nil
+	}
+	if req.URL.Path == "/metrics" {
+		if req.Method != "GET" {
+			return h.errorResponse(req, 405, "405 Method Not Allowed", "Method not allowed"), nil
+		}
+		return h.metricsResponse(req), nil
+	}
+	if req.URL.Path != "/cache" {
+		return h.errorResponse(req, 404, "404 Not Found", "Unknown admin endpoint"), nil
+	}
+	switch req.Method {
+	case "GET":
+		return h.inspect(req, ctx)
+	case "DELETE":
+		return h.purge(req, ctx)
+	}
+	return h.errorResponse(req, 405, "405 Method Not Allowed", "Method not allowed"), nil
+}
+
+func (h *AdminHandler) inspect(req *http.Request, ctx RequestContext) (*http.Response, error) {
+	key, ok := h.requestKey(req.URL.Query())
+	if !ok {
+		return h.errorResponse(req, 400, "400 Bad Request", "Missing key or url parameter"), nil
+	}
+	c := h.cache.context(ctx.Logger)
+	cr, err := c.getCache(req.Context(), key)
+	if err == cache.ErrCacheMiss && !strings.HasSuffix(key, NEGATIVE_KEY_SUFFIX) {
+		key = negativeKey(key)
+		cr, err = c.getCache(req.Context(), key)
+	}
+	if err == cache.ErrCacheMiss {
+		return h.errorResponse(req, 404, "404 Not Found", "Cache entry not found"), nil
+	} else if err == cache.ErrCircuitOpen {
+		return h.unavailableResponse(req), nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return h.jsonResponse(req, cacheEntryInfo{
+		Key:        key,
+		Status:     cr.Status,
+		StatusCode: cr.StatusCode,
+		Header:     cr.Header,
+		Size:       cr.bodySize(),
+		StoredSize: cr.storedSize(),
+		Encoding:   cr.Encoding,
+		Vary:       cr.Vary,
+		BodyHash:   cr.BodyHash,
+		Negative:   cr.Negative,
+		Chunks:     len(cr.Chunks),
+		StoredAt:   cr.StoredAt,
+		Age:        int64(cr.age(now) / time.Second),
+		TTL:        int64(cr.ttl(now) / time.Second),
+		Fresh:      cr.fresh(now),
+	})
+}
+
+func (h *AdminHandler) purge(req *http.Request, ctx RequestContext) (*http.Response, error) {
+	query := req.URL.Query()
+	var purged int
+	var err error
+	if key, ok := h.requestKey(query); ok {
+		purged, err = h.purgeKey(req.Context(), key)
+	} else if prefix, ok := query["prefix"]; ok {
+		purged, err = h.purgeMatching(req.Context(), prefix[0], nil)
+	} else if pattern := query.Get("glob"); pattern != "" {
+		g, gerr := glob.Compile(pattern, '/')
+		if gerr != nil {
+			return h.errorResponse(req, 400, "400 Bad Request", gerr.Error()), nil
+		}
+		purged, err = h.purgeMatching(req.Context(), g.Prefix(), g.Match)
+	} else {
+		return h.errorResponse(req, 400, "400 Bad Request", "Missing key, url, prefix, or glob parameter"), nil
+	}
+	if err == cache.ErrNotSupported {
+		return h.errorResponse(req, 501, "501 Not Implemented", "Cache backend does not support listing keys"), nil
+	} else if err == cache.ErrCircuitOpen {
+		return h.unavailableResponse(req), nil
+	} else if err != nil {
+		return nil, err
+	}
+	ctx.Logger.Infof("Cache PURGE: %s (%d entries)", req.URL.RawQuery, purged)
+	return h.jsonResponse(req, purgeResult{
+		Purged: purged,
+	})
+}
+
+func (h *AdminHandler) purgeMatching(ctx context.Context, prefix string, match func(string) bool) (int, error) {
+	keys, err := h.cache.cache.Keys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, key := range keys {
+		// Chunks are purged along with the entries that reference them,
+		// while shared bodies are left to expire.
+		if strings.HasPrefix(key, CHUNK_KEY_PREFIX) || strings.HasPrefix(key, BODY_KEY_PREFIX) {
+			continue
+		}
+		if match != nil && !match(key) {
+			continue
+		}
+		n, err := h.purgeKey(ctx, key)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (h *AdminHandler) purgeKey(ctx context.Context, key string) (int, error) {
+	c := h.cache.cache
+	cr := &cachedResponse{}
+	err := c.Get(ctx, key, cr)
+	if err == cache.ErrCacheMiss {
+		return 0, nil
+	} else if err == nil {
+		for _, chunkKey := range cr.Chunks {
+			if err := c.Delete(ctx, chunkKey); err != nil {
+				return 0, err
+			}
+		}
+		if cr.isVariantIndex() {
+			if err := h.purgeVariants(ctx, key); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// Entries that fail to decode are still removed. A body shared through
+	// its hash stays in place for the other entries that reference it.
+	if err := c.Delete(ctx, key); err != nil {
+		return 0, err
+	}
+	if !strings.HasSuffix(key, NEGATIVE_KEY_SUFFIX) {
+		if err := c.Delete(ctx, negativeKey(key)); err != nil {
+			return 0, err
+		}
+	}
+	return 1, nil
+}
+
+func (h *AdminHandler) purgeVariants(ctx context.Context, base string) error {
+	keys, err := h.cache.cache.Keys(ctx, base+VARIANT_KEY_SEPARATOR)
+	if err == cache.ErrNotSupported {
+		// The variants can't be found, but they are no longer reachable
+		// once the index is gone.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := h.purgeKey(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *AdminHandler) requestKey(query url.Values) (string, bool) {
+	if key, ok := query["key"]; ok {
+		return key[0], true
+	}
+	if rawURL := query.Get("url"); rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err == nil {
+			return h.cache.keys.Key(u), true
+		}
+	}
+	return "", false
+}
+
+func (h *AdminHandler) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || h.token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) jsonResponse(req *http.Request, v interface{}) (*http.Response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return httplib.NewResponseBuilder(req, h.version).
+		StatusCode(200).
+		Status("200 OK").
+		AddHeader("Content-Type", "application/json").
+		BodyBytes(b).
+		Build(), nil
+}
+
+func (h *AdminHandler) metricsResponse(req *http.Request) *http.Response {
+	buf := &bytes.Buffer{}
+	metrics.DefaultRegistry.WriteTo(buf)
+	return httplib.NewResponseBuilder(req, h.version).
+		StatusCode(200).
+		Status("200 OK").
+		AddHeader("Content-Type", "text/plain").
+		BodyBytes(buf.Bytes()).
+		Build()
+}
+
+func (h *AdminHandler) unavailableResponse(req *http.Request) *http.Response {
+	return h.errorResponse(req, 503, "503 Service Unavailable", "Cache backend is unavailable")
+}
+
+func (h *AdminHandler) errorResponse(req *http.Request, statusCode int, status string, message string) *http.Response {
+	return httplib.NewResponseBuilder(req, h.version).
+		StatusCode(statusCode).
+		Status(status).
+		BodyString(fmt.Sprintf("%s\n", message)).
+		Build()
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/logger"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_PAX_KEY      = "GBFPROXY.key"
+	ARCHIVE_PAX_TTL      = "GBFPROXY.ttl"
+	ARCHIVE_PAX_RESPONSE = "GBFPROXY.response"
+)
+
+// Export writes every cache entry into a tar archive, one file per entry.
+// The file holds the response body while the key, the remaining TTL in
+// seconds and the rest of the response are stored as PAX records.
+func (h *CacheHandler) Export(ctx context.Context, w io.Writer) (int, error) {
+	keys, err := h.cache.Keys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(w)
+	exported := 0
+	for _, key := range keys {
+		if strings.HasPrefix(key, CHUNK_KEY_PREFIX) || strings.HasPrefix(key, BODY_KEY_PREFIX) {
+			continue
+		}
+		ok, err := h.exportEntry(ctx, tw, key)
+		if err != nil {
+			return exported, err
+		}
+		if ok {
+			exported++
+		}
+	}
+	return exported, tw.Close()
+}
+
+func (h *CacheHandler) Import(ctx context.Context, r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	imported := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return imported, nil
+		} else if err != nil {
+			return imported, err
+		}
+		ok, err := h.importEntry(ctx, hdr, tr)
+		if err != nil {
+			return imported, err
+		}
+		if ok {
+			imported++
+		}
+	}
+}
+
+func (h *CacheHandler) exportEntry(ctx context.Context, tw *tar.Writer, key string) (bool, error) {
+	log := logger.DefaultLogger
+	cr, err := h.context(log).getCache(ctx, key)
+	if err != nil {
+		if err != cache.ErrCacheMiss {
+			log.Errorf("Cache EXPORT: skipping %s (%s)", key, err)
+		}
+		return false, nil
+	}
+	ttl := cr.ttl(time.Now())
+	if ttl <= 0 {
+		return false, nil
+	}
+	// The body is read up front so that an entry with missing chunks can be
+	// skipped without leaving a truncated file in the archive.
+	body, err := ioutil.ReadAll(cr.newReader(ctx, h.cache))
+	if err != nil {
+		log.Errorf("Cache EXPORT: skipping %s (%s)", key, err)
+		return false, nil
+	}
+
+	meta := *cr
+	meta.Body = nil
+	meta.Chunks = nil
+	meta.Encoding = ""
+	meta.EncodedLength = 0
+	meta.BodyHash = ""
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	sum := sha1.Sum([]byte(key))
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     hex.EncodeToString(sum[:]),
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  cr.StoredAt,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			ARCHIVE_PAX_KEY:      key,
+			ARCHIVE_PAX_TTL:      strconv.FormatInt(int64(ttl/time.Second), 10),
+			ARCHIVE_PAX_RESPONSE: string(b),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = tw.Write(body)
+	return err == nil, err
+}
+
+func (h *CacheHandler) importEntry(ctx context.Context, hdr *tar.Header, r io.Reader) (bool, error) {
+	key, ok := hdr.PAXRecords[ARCHIVE_PAX_KEY]
+	if !ok || hdr.Typeflag != tar.TypeReg {
+		return false, nil
+	}
+	ttl, err := strconv.ParseInt(hdr.PAXRecords[ARCHIVE_PAX_TTL], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("Invalid TTL for archived entry %s: %s", key, err)
+	}
+	cr := &cachedResponse{}
+	err = json.Unmarshal([]byte(hdr.PAXRecords[ARCHIVE_PAX_RESPONSE]), cr)
+	if err != nil {
+		return false, fmt.Errorf("Invalid archived entry %s: %s", key, err)
+	}
+	if ttl <= 0 {
+		return false, nil
+	}
+	return true, h.putCacheBody(ctx, key, cr, r, time.Duration(ttl)*time.Second)
+}
+
+// putCacheBody stores an entry synchronously, unlike cacheWriter which
+// gives up rather than holding back the client.
+func (h *CacheHandler) putCacheBody(ctx context.Context, key string, cr *cachedResponse, r io.Reader, ttl time.Duration) error {
+	decoded := &countingReader{Reader: r}
+	r = decoded
+	cr.Encoding = ""
+	if h.codec != nil && shouldCompress(cr) {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			enc := h.codec.NewWriter(pw)
+			_, err := io.Copy(enc, decoded)
+			if err == nil {
+				err = enc.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		r = pr
+		cr.Encoding = h.codec.Name()
+	}
+
+	id := newChunkID()
+	var chunks []string
+	var body []byte
+	written := int64(0)
+	for {
+		buf := make([]byte, CACHE_CHUNK_SIZE)
+		n, err := io.ReadFull(r, buf)
+		written += int64(n)
+		if n > 0 && (n == CACHE_CHUNK_SIZE || len(chunks) > 0) {
+			chunk := chunkKey(id, len(chunks))
+			if err := h.cache.Set(ctx, chunk, &cachedChunk{Data: buf[:n]}, ttl); err != nil {
+				return err
+			}
+			chunks = append(chunks, chunk)
+		} else if n > 0 {
+			body = buf[:n]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	cr.Body = body
+	cr.Chunks = chunks
+	cr.ContentLength = decoded.n
+	cr.EncodedLength = 0
+	if cr.Encoding != "" {
+		cr.EncodedLength = written
+	}
+	return h.cache.Set(ctx, key, cr, ttl)
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -1,61 +1,158 @@
 package handlers
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"gbf-proxy/lib/admission"
 	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/cachekey"
+	"gbf-proxy/lib/cachepolicy"
+	"gbf-proxy/lib/compression"
+	"gbf-proxy/lib/hostrules"
+	httplib "gbf-proxy/lib/http"
 	"gbf-proxy/lib/logger"
+	"gbf-proxy/lib/metrics"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const VARIANT_KEY_SEPARATOR = "#variant:"
+
+const (
+	DEFAULT_NEGATIVE_TTL = time.Minute
+	// Negative entries are kept apart from the successful responses that
+	// they must never replace
+	NEGATIVE_KEY_SUFFIX = "#negative"
 )
 
 type CacheHandler struct {
-	handler   RequestHandler
-	cache     cache.Client
-	hostCache map[string]bool
+	handler     RequestHandler
+	cache       cache.Client
+	hostRules   *hostrules.Engine
+	coalescer   *RequestCoalescer
+	keys        *cachekey.Normalizer
+	codec       compression.Codec
+	negativeTTL time.Duration
+	policy      *atomic.Value
+	admission   admission.Filter
+	pending     *sync.WaitGroup
 }
 
 type CacheContext struct {
-	handler   RequestHandler
-	cache     cache.Client
-	hostCache map[string]bool
-	log       *logger.Logger
-}
-
-type cachedResponse struct {
-	Proto            string
-	ProtoMajor       int
-	ProtoMinor       int
-	Status           string
-	StatusCode       int
-	Header           http.Header
-	Body             []byte
-	ContentLength    int64
-	TransferEncoding []string
-	Uncompressed     bool
-	Trailer          http.Header
+	handler     RequestHandler
+	cache       cache.Client
+	hostRules   *hostrules.Engine
+	coalescer   *RequestCoalescer
+	keys        *cachekey.Normalizer
+	codec       compression.Codec
+	negativeTTL time.Duration
+	policy      *atomic.Value
+	admission   admission.Filter
+	pending     *sync.WaitGroup
+	log         *logger.Logger
+}
+
+type CacheOptions struct {
+	CoalesceTimeout time.Duration
+	KeyNormalizer   *cachekey.Normalizer
+	Compression     compression.Codec
+	// NegativeTTL is how long 404 and 410 responses are cached for, or 0
+	// to not cache them at all.
+	NegativeTTL time.Duration
+	Policy      *cachepolicy.Policy
+	// Admission is consulted before a new entry is stored, or nil to store
+	// every cacheable response.
+	Admission admission.Filter
+	HostRules *hostrules.Engine
 }
 
 var _ RequestHandler = (*CacheHandler)(nil)
 
-func NewCacheHandler(rh RequestHandler, c cache.Client) *CacheHandler {
-	return &CacheHandler{
-		handler:   rh,
-		cache:     c,
-		hostCache: make(map[string]bool),
+func NewCacheHandler(rh RequestHandler, c cache.Client, opts CacheOptions) *CacheHandler {
+	keys := opts.KeyNormalizer
+	if keys == nil {
+		keys = cachekey.DefaultNormalizer
+	}
+	policy := opts.Policy
+	if policy == nil {
+		policy = cachepolicy.DefaultPolicy
+	}
+	hostRules := opts.HostRules
+	if hostRules == nil {
+		hostRules = hostrules.MustNewEngine(nil)
+	}
+	h := &CacheHandler{
+		handler:     rh,
+		cache:       c,
+		hostRules:   hostRules,
+		coalescer:   NewRequestCoalescer(opts.CoalesceTimeout),
+		keys:        keys,
+		codec:       opts.Compression,
+		negativeTTL: opts.NegativeTTL,
+		policy:      &atomic.Value{},
+		admission:   opts.Admission,
+		pending:     &sync.WaitGroup{},
 	}
+	h.policy.Store(policy)
+	return h
 }
 
 func (h *CacheHandler) HandleRequest(req *http.Request, ctx RequestContext) (*http.Response, error) {
-	return (CacheContext{
-		handler:   h.handler,
-		cache:     h.cache,
-		hostCache: h.hostCache,
-		log:       ctx.Logger,
-	}).HandleRequest(req, ctx)
+	return h.context(ctx.Logger).HandleRequest(req, ctx)
+}
+
+func (h *CacheHandler) ShouldCacheRequest(req *http.Request) bool {
+	return h.context(logger.DefaultLogger).shouldCacheRequest(req)
+}
+
+func (h *CacheHandler) Cached(req *http.Request) (bool, error) {
+	c := h.context(logger.DefaultLogger)
+	_, cr, err := c.lookupCache(c.getCacheKey(req.URL), req)
+	if err == cache.ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return cr.fresh(time.Now()) && !cr.Negative, nil
+}
+
+// SetPolicy replaces the cache policy for the requests that follow.
+func (h *CacheHandler) SetPolicy(p *cachepolicy.Policy) {
+	h.policy.Store(p)
+}
+
+// Wait blocks until responses that are being written to the cache have
+// been stored.
+func (h *CacheHandler) Wait() {
+	h.pending.Wait()
+}
+
+// Close waits for pending writes and closes the cache client.
+func (h *CacheHandler) Close() error {
+	h.Wait()
+	return h.cache.Close()
+}
+
+func (h *CacheHandler) context(log *logger.Logger) CacheContext {
+	return CacheContext{
+		handler:     h.handler,
+		cache:       h.cache,
+		hostRules:   h.hostRules,
+		coalescer:   h.coalescer,
+		keys:        h.keys,
+		codec:       h.codec,
+		negativeTTL: h.negativeTTL,
+		policy:      h.policy,
+		admission:   h.admission,
+		pending:     h.pending,
+		log:         log,
+	}
 }
 
 func (c CacheContext) HandleRequest(req *http.Request, ctx RequestContext) (*http.Response, error) {
@@ -63,136 +160,407 @@ func (c CacheContext) HandleRequest(req *http.Request, ctx RequestContext) (*htt
 		return c.handler.HandleRequest(req, ctx)
 	}
 
-	key := c.getCacheKey(req.URL)
-	exists, err := c.cache.Has(key)
-	if err != nil {
-		c.log.Error("Cache ERROR:", err)
-	} else if !exists {
+	base := c.getCacheKey(req.URL)
+	key, cr, err := c.lookupCache(base, req)
+	if err == nil {
+		now := time.Now()
+		if cr.fresh(now) {
+			c.log.Info("Cache HIT:", key)
+			// Negative entries keep the expiration they were capped at
+			if d := c.decide(req, cr); d.Sliding && !cr.Negative {
+				c.slideExpiration(base, key, cr, d.TTL)
+			}
+			return cr.unmarshal(req, c.cache), nil
+		} else if cr.staleServable(now) {
+			c.log.Info("Cache STALE:", key)
+			res := cr.unmarshal(req, c.cache)
+			c.pending.Add(1)
+			go c.revalidateAsync(base, key, cr, req, ctx)
+			return res, nil
+		}
+		if cr.Negative {
+			// Missing assets are fetched again in full in case they have
+			// been added since.
+			c.log.Info("Cache MISS:", key)
+			cr = nil
+		} else {
+			c.log.Info("Cache REVALIDATE:", key)
+		}
+	} else if err == cache.ErrCacheMiss {
 		c.log.Info("Cache MISS:", key)
+		cr = nil
+	} else if err == cache.ErrCircuitOpen {
+		return c.handler.HandleRequest(req, ctx)
 	} else {
-		c.log.Info("Cache HIT:", key)
-		return c.getCache(key, req)
+		c.log.Error("Cache ERROR:", err)
+		return c.handler.HandleRequest(req, ctx)
+	}
+
+	flight, leader := c.coalescer.Join(key)
+	if !leader {
+		return c.handleFollower(base, key, flight, req, ctx)
+	}
+	return c.fetch(base, key, cr, flight, req, ctx)
+}
+
+func (c CacheContext) handleFollower(base string, key string, flight *requestFlight, req *http.Request, ctx RequestContext) (*http.Response, error) {
+	c.log.Info("Cache WAIT:", key)
+	if c.coalescer.Wait(flight) {
+		// The leader may have stored a variant other than the one this
+		// request negotiates for.
+		key, cr, err := c.lookupCache(base, req)
+		if err == nil {
+			c.log.Info("Cache HIT:", key)
+			return cr.unmarshal(req, c.cache), nil
+		} else if err != cache.ErrCacheMiss && err != cache.ErrCircuitOpen {
+			c.log.Error("Cache ERROR:", err)
+		}
 	}
+	c.log.Info("Cache BYPASS:", key)
+	return c.handler.HandleRequest(req, ctx)
+}
 
-	res, err := c.handler.HandleRequest(req, ctx)
+func (c CacheContext) fetch(base string, key string, stale *cachedResponse, flight *requestFlight, req *http.Request, ctx RequestContext) (*http.Response, error) {
+	// Conditional and range headers from the client are left out so that
+	// upstream always answers with the full response that can be cached.
+	upstreamReq := httplib.UnconditionalRequest(req)
+	if stale != nil {
+		upstreamReq = httplib.RevalidationRequest(req, stale.Header)
+	}
+	res, err := c.handler.HandleRequest(upstreamReq, ctx)
 	if err != nil {
+		c.coalescer.Finish(key, flight, false)
+		if stale != nil {
+			c.log.Error("Cache STALE:", err)
+			return stale.unmarshal(req, c.cache), nil
+		}
 		return nil, err
 	}
-	if !c.shouldCacheResponse(res) {
+
+	if stale != nil && (res.StatusCode == 304 || res.StatusCode >= 500) {
+		res.Body.Close()
+		if res.StatusCode == 304 {
+			stale.revalidated(res.Header, time.Now())
+			stale.StorageTTL = c.decide(req, stale).TTL
+			c.refreshCache(base, key, stale, func(ok bool) {
+				c.coalescer.Finish(key, flight, ok)
+			})
+		} else {
+			c.log.Errorf("Cache STALE: upstream responded with %s", res.Status)
+			c.coalescer.Finish(key, flight, false)
+		}
+		return stale.unmarshal(req, c.cache), nil
+	}
+
+	cr := newCachedResponse(res)
+	decision := c.decide(req, cr)
+	cr.StorageTTL = decision.TTL
+	if negativeStatus(res.StatusCode) {
+		cr.markNegative(c.negativeTTL)
+	}
+	if !decision.Cache || !c.shouldCacheResponse(res, cr) {
+		c.coalescer.Finish(key, flight, false)
+		return res, nil
+	}
+	// Entries that are being revalidated were already admitted
+	if stale == nil && !c.admit(base) {
+		c.coalescer.Finish(key, flight, false)
 		return res, nil
 	}
-	return c.putCacheAsync(key, req, res)
+	storeKey := base
+	if cr.Negative {
+		storeKey = negativeKey(base)
+	} else if len(cr.Vary) > 0 {
+		storeKey = variantKey(base, cr.Vary, req)
+	}
+	return c.putCacheStream(storeKey, req, res, cr, func(ok bool) {
+		if ok && len(cr.Vary) > 0 {
+			ok = c.putVariantIndex(base, cr)
+		}
+		if ok && !cr.Negative && c.negativeTTL > 0 {
+			// The asset exists now, so the negative entry must not be
+			// served again once this one expires.
+			if err := c.cache.Delete(context.Background(), negativeKey(base)); err != nil {
+				c.logError(err)
+			}
+		}
+		c.coalescer.Finish(key, flight, ok)
+	}), nil
+}
+
+func (c CacheContext) revalidateAsync(base string, key string, stale *cachedResponse, req *http.Request, ctx RequestContext) {
+	defer c.pending.Done()
+	flight, leader := c.coalescer.Join(key)
+	if !leader {
+		return
+	}
+	res, err := c.fetch(base, key, stale, flight, req, ctx)
+	if err != nil {
+		c.log.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	// Only a fresh upstream body needs to be read through for it to be
+	// written to the cache.
+	if _, ok := res.Body.(*cacheBody); ok {
+		io.Copy(ioutil.Discard, res.Body)
+	}
 }
 
 func (c CacheContext) shouldCacheRequest(req *http.Request) bool {
 	if req.Method != "GET" {
 		return false
 	}
+	return matchHost(c.hostRules, req.URL).Cache
+}
 
-	host := req.URL.Hostname()
-	if v, ok := c.hostCache[host]; ok {
-		return v
-	} else if strings.HasPrefix(host, "game-a") && strings.HasSuffix(host, ".granbluefantasy.jp") {
-		// do nothing
-	} else if strings.HasPrefix(host, "gbf.game-a") && strings.HasSuffix(host, ".mbga.jp") {
-		// do nothing
-	} else {
+func (c CacheContext) shouldCacheResponse(res *http.Response, cr *cachedResponse) bool {
+	if res.StatusCode == 206 || !cr.cacheable() {
 		return false
 	}
-	c.hostCache[host] = true
-	return true
+	if len(cr.Vary) == 1 && cr.Vary[0] == "*" {
+		return false
+	}
+	if negativeStatus(res.StatusCode) {
+		// A variant index for a missing asset could replace the entry of
+		// one that exists, so only plain negative responses are cached.
+		return c.negativeTTL > 0 && len(cr.Vary) == 0
+	}
+	return res.StatusCode >= 200 && res.StatusCode < 300
 }
 
-func (c CacheContext) shouldCacheResponse(res *http.Response) bool {
-	return res.StatusCode >= 200 && res.StatusCode < 300
+func (c CacheContext) admit(key string) bool {
+	if c.admission == nil {
+		return true
+	}
+	registry := metrics.DefaultRegistry
+	if c.admission.Admit(key) {
+		registry.Counter("admission.admitted").Inc()
+		return true
+	}
+	registry.Counter("admission.rejected").Inc()
+	c.log.Info("Cache REJECT:", key)
+	return false
 }
 
-func (c CacheContext) getCache(key string, req *http.Request) (*http.Response, error) {
+func (c CacheContext) decide(req *http.Request, cr *cachedResponse) cachepolicy.Decision {
+	policy := c.policy.Load().(*cachepolicy.Policy)
+	return policy.Match(req.URL.Hostname(), req.URL.Path, cr.Header.Get("Content-Type"))
+}
+
+// lookupCache resolves the variant that matches the request when the entry
+// at the given key is a variant index.
+func (c CacheContext) lookupCache(key string, req *http.Request) (string, *cachedResponse, error) {
+	cr, err := c.getCache(req.Context(), key)
+	if err == cache.ErrCacheMiss && c.negativeTTL > 0 {
+		negative := negativeKey(key)
+		if cr, err := c.getCache(req.Context(), negative); err == nil {
+			return negative, cr, nil
+		}
+	}
+	if err != nil || !cr.isVariantIndex() {
+		return key, cr, err
+	}
+	key = variantKey(key, cr.Vary, req)
+	cr, err = c.getCache(req.Context(), key)
+	return key, cr, err
+}
+
+func (c CacheContext) getCache(ctx context.Context, key string) (*cachedResponse, error) {
 	cr := &cachedResponse{}
-	err := c.cache.Get(key, cr)
+	err := c.cache.Get(ctx, key, cr)
 	if err != nil {
 		return nil, err
 	}
-	return cr.unmarshal(req), nil
+	cr.owner = key
+	if cr.BodyHash != "" {
+		body := &cachedBody{}
+		err := c.cache.Get(ctx, bodyKey(cr.BodyHash), body)
+		if err != nil {
+			return nil, err
+		}
+		cr.setBody(body)
+		cr.owner = bodyKey(cr.BodyHash)
+	}
+	if err := c.prefetchChunks(ctx, cr); err != nil {
+		return nil, err
+	}
+	return cr, nil
 }
 
-func (c CacheContext) putCacheAsync(key string, req *http.Request, res *http.Response) (*http.Response, error) {
-	cr, err := marshalResponse(res)
-	if err != nil {
-		return nil, err
+// prefetchChunks fetches the first chunks of an entry, since chunks can be
+// evicted on their own. An entry that is missing any of them is dropped and
+// treated as a miss, rather than sending the headers of a body that can't
+// be completed.
+func (c CacheContext) prefetchChunks(ctx context.Context, cr *cachedResponse) error {
+	if len(cr.Chunks) <= 0 {
+		return nil
+	}
+	keys := cr.Chunks
+	if len(keys) > CACHE_CHUNK_READ_AHEAD {
+		keys = keys[:CACHE_CHUNK_READ_AHEAD]
+	}
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		values[key] = &cachedChunk{}
 	}
+	if err := c.cache.GetMulti(ctx, values); err != nil {
+		return err
+	}
+	if len(values) < len(keys) {
+		c.log.Infof("Cache EVICTED: %s (missing chunks)", cr.owner)
+		c.cache.Delete(ctx, cr.owner)
+		return cache.ErrCacheMiss
+	}
+	cr.prefetched = make(map[string]*cachedChunk, len(values))
+	for key, chunk := range values {
+		cr.prefetched[key] = chunk.(*cachedChunk)
+	}
+	return nil
+}
+
+func (c CacheContext) putCacheStream(key string, req *http.Request, res *http.Response, cr *cachedResponse, done func(bool)) *http.Response {
+	res.Body = &cacheBody{
+		ReadCloser: res.Body,
+		writer:     newCacheWriter(c, key, cr, done),
+	}
+	return res
+}
+
+func (c CacheContext) refreshCache(base string, key string, cr *cachedResponse, done func(bool)) {
+	c.pending.Add(1)
 	go func() {
-		err := c.putCache(key, cr)
+		defer c.pending.Done()
+		err := c.putCacheEntry(key, cr)
 		if err != nil {
-			c.log.Error(err)
+			c.logError(err)
+			done(false)
+			return
+		}
+		c.log.Info("Cache REFRESH:", key)
+		if len(cr.Vary) > 0 {
+			done(c.putVariantIndex(base, cr))
+			return
+		}
+		done(true)
+	}()
+}
+
+// slideExpiration extends the expiration of an entry that was hit, along
+// with the variant index and body that it depends on.
+func (c CacheContext) slideExpiration(base string, key string, cr *cachedResponse, ttl time.Duration) {
+	if ttl <= 0 {
+		// Extend the entry by the TTL it was stored with
+		ttl = cr.ttl(cr.StoredAt)
+	}
+	keys := make([]string, 0, len(cr.Chunks)+3)
+	// A shared body is only touched when that extends it, since it may be
+	// kept for longer by another entry.
+	if cr.BodyHash == "" || cr.bodyExpiresAt.Before(time.Now().Add(ttl)) {
+		keys = append(keys, cr.Chunks...)
+		if cr.BodyHash != "" {
+			keys = append(keys, bodyKey(cr.BodyHash))
+		}
+	}
+	keys = append(keys, key)
+	if base != key {
+		keys = append(keys, base)
+	}
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+		ctx := context.Background()
+		for _, k := range keys {
+			err := c.cache.Touch(ctx, k, ttl)
+			if err != nil && err != cache.ErrCacheMiss {
+				c.logError(err)
+				return
+			}
 		}
 	}()
-	return cr.unmarshal(req), nil
 }
 
-func (c CacheContext) putCache(key string, cr *cachedResponse) error {
-	err := c.cache.Set(key, cr)
+func (c CacheContext) putVariantIndex(base string, cr *cachedResponse) bool {
+	index := newVariantIndex(cr)
+	err := c.cache.Set(context.Background(), base, index, index.ttl(time.Now()))
 	if err != nil {
+		c.logError(err)
+		return false
+	}
+	return true
+}
+
+func (c CacheContext) putCacheEntry(key string, cr *cachedResponse) error {
+	ctx := context.Background()
+	ttl := cr.ttl(time.Now())
+	if cr.BodyHash != "" {
+		body := &cachedBody{}
+		if err := c.cache.Get(ctx, bodyKey(cr.BodyHash), body); err != nil {
+			return err
+		}
+		if err := c.extendBody(ctx, cr.BodyHash, body, ttl); err != nil {
+			return err
+		}
+	} else if err := c.refreshChunks(ctx, cr.Chunks, ttl); err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, key, cr.entry(), ttl)
+}
+
+// extendBody makes sure that a shared body lives at least as long as the
+// entry that is about to reference it.
+func (c CacheContext) extendBody(ctx context.Context, hash string, body *cachedBody, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl)
+	if !body.ExpiresAt.Before(expiresAt) {
+		return nil
+	}
+	if err := c.refreshChunks(ctx, body.Chunks, ttl); err != nil {
 		return err
 	}
-	c.log.Infof("Cache PUT: %s", key)
+	body.ExpiresAt = expiresAt
+	return c.cache.Set(ctx, bodyKey(hash), body, ttl)
+}
+
+// refreshChunks writes the chunks again so that they don't expire before
+// the entry that references them.
+func (c CacheContext) refreshChunks(ctx context.Context, chunks []string, ttl time.Duration) error {
+	for _, chunkKey := range chunks {
+		chunk := &cachedChunk{}
+		if err := c.cache.Get(ctx, chunkKey, chunk); err != nil {
+			return err
+		}
+		if err := c.cache.Set(ctx, chunkKey, chunk, ttl); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (c CacheContext) getCacheKey(u *url.URL) string {
-	query := u.RawQuery
-	if query == "" {
-		return u.Path
-	}
-	return fmt.Sprintf("%s?%s", u.Path, query)
+	return c.keys.Key(u)
 }
 
-func marshalResponse(res *http.Response) (*cachedResponse, error) {
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// logError leaves out the errors of an open circuit breaker, which has
+// already logged that the cache is unavailable.
+func (c CacheContext) logError(err error) {
+	if err != cache.ErrCircuitOpen {
+		c.log.Error(err)
 	}
-	return &cachedResponse{
-		Proto:            res.Proto,
-		ProtoMajor:       res.ProtoMajor,
-		ProtoMinor:       res.ProtoMinor,
-		Status:           res.Status,
-		StatusCode:       res.StatusCode,
-		Header:           res.Header,
-		Body:             body,
-		ContentLength:    res.ContentLength,
-		TransferEncoding: res.TransferEncoding,
-		Uncompressed:     res.Uncompressed,
-		Trailer:          res.Trailer,
-	}, nil
-}
-
-func (c *cachedResponse) unmarshal(req *http.Request) *http.Response {
-	header := c.Header
-	aclOrigin := header.Get("Access-Control-Allow-Origin")
-	if aclOrigin != "" {
-		reqOrigin := req.Header.Get("Origin")
-		if reqOrigin == "" {
-			reqOrigin = "*"
-		}
-		header.Set("Access-Control-Allow-Origin", reqOrigin)
-	}
-	return &http.Response{
-		Proto:            c.Proto,
-		ProtoMajor:       c.ProtoMajor,
-		ProtoMinor:       c.ProtoMinor,
-		Status:           c.Status,
-		StatusCode:       c.StatusCode,
-		Header:           header,
-		Body:             c.newReader(),
-		ContentLength:    c.ContentLength,
-		TransferEncoding: c.TransferEncoding,
-		Uncompressed:     c.Uncompressed,
-		Trailer:          c.Trailer,
-		Request:          req,
-	}
-}
-
-func (c *cachedResponse) newReader() io.ReadCloser {
-	return ioutil.NopCloser(bytes.NewReader(c.Body))
+}
+
+func negativeStatus(statusCode int) bool {
+	return statusCode == 404 || statusCode == 410
+}
+
+func negativeKey(base string) string {
+	return base + NEGATIVE_KEY_SUFFIX
+}
+
+func bodyKey(hash string) string {
+	return BODY_KEY_PREFIX + hash
+}
+
+func variantKey(base string, vary []string, req *http.Request) string {
+	sum := sha1.Sum([]byte(httplib.VaryKey(req, vary)))
+	return base + VARIANT_KEY_SEPARATOR + hex.EncodeToString(sum[:])
 }
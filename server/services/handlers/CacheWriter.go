@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gbf-proxy/lib/cache"
+	httplib "gbf-proxy/lib/http"
+	"gbf-proxy/lib/metrics"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_CHUNK_SIZE        = 512 * 1024
+	CACHE_CHUNK_READ_AHEAD  = 4
+	CACHE_WRITE_QUEUE       = 8
+	CACHE_STALE_RETENTION   = 24 * time.Hour
+	CACHE_COMPRESS_MIN_SIZE = 1024
+	CHUNK_KEY_PREFIX        = "chunk:"
+	BODY_KEY_PREFIX         = "body:"
+	CHUNK_ID_BYTE_SIZE      = 16
+)
+
+type cacheWriter struct {
+	ctx  CacheContext
+	key  string
+	cr   *cachedResponse
+	ttl  time.Duration
+	done func(bool)
+
+	id      string
+	buf     []byte
+	chunks  []string
+	written int64
+	stored  int64
+	encoder io.WriteCloser
+	hash    hash.Hash
+	jobs    chan cacheJob
+	once    sync.Once
+	stopped bool
+}
+
+type cacheJob struct {
+	key   string
+	value interface{}
+}
+
+type writerFunc func([]byte) (int, error)
+
+type cacheBody struct {
+	io.ReadCloser
+	writer *cacheWriter
+}
+
+func newCacheWriter(ctx CacheContext, key string, cr *cachedResponse, done func(bool)) *cacheWriter {
+	w := &cacheWriter{
+		ctx:  ctx,
+		key:  key,
+		cr:   cr,
+		ttl:  cr.ttl(time.Now()),
+		done: done,
+		id:   newChunkID(),
+		buf:  make([]byte, 0, CACHE_CHUNK_SIZE),
+		jobs: make(chan cacheJob, CACHE_WRITE_QUEUE),
+		hash: sha256.New(),
+	}
+	if ctx.codec != nil && shouldCompress(cr) {
+		w.encoder = ctx.codec.NewWriter(writerFunc(w.store))
+	}
+	ctx.pending.Add(1)
+	go w.run()
+	return w
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.stopped {
+		return len(p), nil
+	}
+	w.written += int64(len(p))
+	w.hash.Write(p)
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.store(p)
+}
+
+func (w *cacheWriter) store(p []byte) (int, error) {
+	n := len(p)
+	w.stored += int64(n)
+	for len(p) > 0 {
+		free := CACHE_CHUNK_SIZE - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+		if len(w.buf) >= CACHE_CHUNK_SIZE {
+			w.flush()
+		}
+	}
+	return n, nil
+}
+
+func (w *cacheWriter) Commit() {
+	w.once.Do(func() {
+		defer w.stop()
+		if w.stopped {
+			return
+		}
+		if w.cr.ContentLength >= 0 && w.cr.ContentLength != w.written {
+			w.ctx.log.Errorf("Cache ABORT: %s (expected %d bytes, got %d)", w.key, w.cr.ContentLength, w.written)
+			return
+		}
+		w.cr.ContentLength = w.written
+		w.cr.BodyHash = hex.EncodeToString(w.hash.Sum(nil))
+		if w.encoder != nil {
+			if err := w.encoder.Close(); err != nil {
+				w.ctx.log.Error(err)
+				return
+			}
+			w.cr.Encoding = w.ctx.codec.Name()
+			w.cr.EncodedLength = w.stored
+		}
+		if len(w.chunks) > 0 {
+			if len(w.buf) > 0 {
+				w.flush()
+			}
+			w.cr.Chunks = w.chunks
+		} else {
+			w.cr.Body = w.buf
+		}
+		w.enqueue(w.key, w.cr)
+	})
+}
+
+func (w *cacheWriter) Abort() {
+	w.once.Do(w.stop)
+}
+
+func (w *cacheWriter) stop() {
+	w.stopped = true
+	close(w.jobs)
+}
+
+func (w *cacheWriter) flush() {
+	key := chunkKey(w.id, len(w.chunks))
+	w.chunks = append(w.chunks, key)
+	w.enqueue(key, &cachedChunk{
+		Data: w.buf,
+	})
+	w.buf = make([]byte, 0, CACHE_CHUNK_SIZE)
+}
+
+func (w *cacheWriter) enqueue(key string, value interface{}) {
+	if w.stopped {
+		return
+	}
+	select {
+	case w.jobs <- cacheJob{key, value}:
+	default:
+		// The cache can't keep up with the client, so give up on caching
+		// rather than slowing the response down.
+		w.ctx.log.Errorf("Cache ABORT: %s (write queue is full)", w.key)
+		w.stopped = true
+	}
+}
+
+func (w *cacheWriter) run() {
+	defer w.ctx.pending.Done()
+	failed := false
+	stored := false
+	var chunks []string
+	for job := range w.jobs {
+		if failed {
+			continue
+		}
+		var err error
+		if job.key != w.key {
+			err = w.ctx.cache.Set(context.Background(), job.key, job.value, w.ttl)
+			if err == nil {
+				chunks = append(chunks, job.key)
+			}
+		} else {
+			err = w.storeEntry(chunks)
+		}
+		if err != nil {
+			w.ctx.logError(err)
+			failed = true
+		} else if job.key == w.key {
+			w.ctx.log.Infof("Cache PUT: %s", w.key)
+			stored = true
+		}
+	}
+	if !stored {
+		// Chunks of an entry that was abandoned would never be read
+		w.deleteChunks(chunks)
+	}
+	w.done(stored)
+}
+
+// storeEntry points the entry at an identical body that is already stored,
+// or stores the body written by this writer under its hash.
+func (w *cacheWriter) storeEntry(chunks []string) error {
+	ctx := context.Background()
+	c := w.ctx.cache
+	key := bodyKey(w.cr.BodyHash)
+	body := &cachedBody{}
+	err := c.Get(ctx, key, body)
+	if err == nil {
+		w.deleteChunks(chunks)
+		registry := metrics.DefaultRegistry
+		registry.Counter("dedup.hits").Inc()
+		registry.Counter("dedup.bytes_saved").Add(w.cr.storedSize())
+		w.ctx.log.Infof("Cache DEDUP: %s", w.key)
+		err = w.ctx.extendBody(ctx, w.cr.BodyHash, body, w.ttl)
+	} else if err == cache.ErrCacheMiss {
+		err = c.Set(ctx, key, newCachedBody(w.cr, w.ttl), w.ttl)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Set(ctx, w.key, w.cr.entry(), w.ttl)
+}
+
+func (w *cacheWriter) deleteChunks(chunks []string) {
+	for _, chunk := range chunks {
+		w.ctx.cache.Delete(context.Background(), chunk)
+	}
+}
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.writer.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.writer.Commit()
+	} else if err != nil {
+		b.writer.Abort()
+	}
+	return n, err
+}
+
+func (b *cacheBody) Close() error {
+	b.writer.Abort()
+	return b.ReadCloser.Close()
+}
+
+func shouldCompress(cr *cachedResponse) bool {
+	if cr.ContentLength >= 0 && cr.ContentLength < CACHE_COMPRESS_MIN_SIZE {
+		return false
+	}
+	return httplib.Compressible(cr.Header)
+}
+
+func chunkKey(id string, i int) string {
+	return fmt.Sprintf("%s%s:%d", CHUNK_KEY_PREFIX, id, i)
+}
+
+func newChunkID() string {
+	b := make([]byte, CHUNK_ID_BYTE_SIZE)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gbf-proxy/lib/cache"
+	"gbf-proxy/lib/compression"
+	httplib "gbf-proxy/lib/http"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// CACHE_SCHEMA_VERSION must be bumped whenever cachedResponse or cachedChunk
+// change in a way that older entries can't be decoded as.
+const CACHE_SCHEMA_VERSION = 1
+
+type cachedResponse struct {
+	Proto            string
+	ProtoMajor       int
+	ProtoMinor       int
+	Status           string
+	StatusCode       int
+	Header           http.Header
+	Body             []byte
+	Chunks           []string
+	ContentLength    int64
+	TransferEncoding []string
+	Uncompressed     bool
+	Trailer          http.Header
+	Encoding         string
+	EncodedLength    int64
+	Vary             []string
+	BodyHash         string
+	Negative         bool
+
+	StoredAt             time.Time
+	Lifetime             time.Duration
+	StaleWhileRevalidate time.Duration
+	StorageTTL           time.Duration
+
+	bodyExpiresAt time.Time
+	// owner is the key that references the chunks, which is dropped when
+	// one of them turns out to be missing
+	owner      string
+	prefetched map[string]*cachedChunk
+}
+
+// cachedBody is stored under the SHA-256 of the body so that identical
+// responses under different URLs share their storage.
+type cachedBody struct {
+	Body          []byte
+	Chunks        []string
+	ContentLength int64
+	Encoding      string
+	EncodedLength int64
+	ExpiresAt     time.Time
+}
+
+type cachedChunk struct {
+	Data []byte
+}
+
+type chunkReader struct {
+	ctx        context.Context
+	cache      cache.Client
+	chunks     []string
+	fetched    []*cachedChunk
+	reader     *bytes.Reader
+	skip       int64
+	owner      string
+	prefetched map[string]*cachedChunk
+}
+
+type errorReader struct {
+	err error
+}
+
+var _ cache.Sizer = (*cachedResponse)(nil)
+var _ cache.Sizer = (*cachedBody)(nil)
+var _ cache.Sizer = (*cachedChunk)(nil)
+
+func newCachedResponse(res *http.Response) *cachedResponse {
+	cr := &cachedResponse{
+		Proto:            res.Proto,
+		ProtoMajor:       res.ProtoMajor,
+		ProtoMinor:       res.ProtoMinor,
+		Status:           res.Status,
+		StatusCode:       res.StatusCode,
+		Header:           res.Header.Clone(),
+		ContentLength:    res.ContentLength,
+		TransferEncoding: res.TransferEncoding,
+		Uncompressed:     res.Uncompressed,
+		Trailer:          res.Trailer.Clone(),
+	}
+	if vary := httplib.ParseVary(res.Header); len(vary) > 0 {
+		cr.Vary = vary
+	}
+	cr.updateFreshness(time.Now())
+	return cr
+}
+
+// newVariantIndex creates the entry that records which request headers
+// select between the variants of a response. It keeps the freshness of the
+// variant so that it expires along with it.
+func newVariantIndex(c *cachedResponse) *cachedResponse {
+	return &cachedResponse{
+		Header:               c.Header,
+		Vary:                 c.Vary,
+		StoredAt:             c.StoredAt,
+		Lifetime:             c.Lifetime,
+		StaleWhileRevalidate: c.StaleWhileRevalidate,
+		StorageTTL:           c.StorageTTL,
+	}
+}
+
+func (c *cachedResponse) updateFreshness(now time.Time) {
+	f := httplib.ResponseFreshness(c.Header, now, cache.DEFAULT_EXPIRATION)
+	c.StoredAt = now.Add(-httplib.ResponseAge(c.Header))
+	c.Lifetime = f.Lifetime
+	c.StaleWhileRevalidate = f.StaleWhileRevalidate
+	if !f.Cacheable {
+		c.Lifetime = -1
+	}
+}
+
+// markNegative caps the lifetime of a 404 or 410 response, which is never
+// served stale.
+func (c *cachedResponse) markNegative(ttl time.Duration) {
+	c.Negative = true
+	if c.Lifetime > ttl {
+		c.Lifetime = ttl
+	}
+	c.StaleWhileRevalidate = 0
+}
+
+func (c *cachedResponse) revalidated(header http.Header, now time.Time) {
+	// The header may be shared with other decoded copies of the entry, so
+	// it is replaced rather than updated in place.
+	updated := c.Header.Clone()
+	for key, values := range header {
+		if key == "Content-Length" || key == "Transfer-Encoding" {
+			continue
+		}
+		updated[key] = values
+	}
+	c.Header = updated
+	c.updateFreshness(now)
+}
+
+func newCachedBody(c *cachedResponse, ttl time.Duration) *cachedBody {
+	return &cachedBody{
+		Body:          c.Body,
+		Chunks:        c.Chunks,
+		ContentLength: c.ContentLength,
+		Encoding:      c.Encoding,
+		EncodedLength: c.EncodedLength,
+		ExpiresAt:     time.Now().Add(ttl),
+	}
+}
+
+func (c *cachedResponse) setBody(b *cachedBody) {
+	c.Body = b.Body
+	c.Chunks = b.Chunks
+	c.ContentLength = b.ContentLength
+	c.Encoding = b.Encoding
+	c.EncodedLength = b.EncodedLength
+	c.bodyExpiresAt = b.ExpiresAt
+}
+
+// entry returns the record stored under the URL key, which leaves out the
+// body when it is stored separately.
+func (c *cachedResponse) entry() *cachedResponse {
+	if c.BodyHash == "" {
+		return c
+	}
+	e := *c
+	e.Body = nil
+	e.Chunks = nil
+	return &e
+}
+
+func (c *cachedResponse) isVariantIndex() bool {
+	return c.StatusCode == 0 && len(c.Vary) > 0
+}
+
+func (c *cachedResponse) cacheable() bool {
+	return c.Lifetime >= 0 && c.ttl(time.Now()) > 0
+}
+
+func (c *cachedResponse) fresh(now time.Time) bool {
+	return c.age(now) < c.Lifetime
+}
+
+func (c *cachedResponse) staleServable(now time.Time) bool {
+	return c.age(now) < c.Lifetime+c.StaleWhileRevalidate
+}
+
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	return now.Sub(c.StoredAt)
+}
+
+// ttl keeps entries with validators around after they go stale so that
+// they can be revalidated with a conditional request. Negative entries are
+// fetched again instead, so they expire as soon as they go stale. A TTL set
+// by the cache policy replaces both.
+func (c *cachedResponse) ttl(now time.Time) time.Duration {
+	if c.Negative {
+		return c.Lifetime - c.age(now)
+	} else if c.StorageTTL > 0 {
+		return c.StorageTTL - c.age(now)
+	}
+	retention := c.StaleWhileRevalidate
+	if httplib.HasValidators(c.Header) && retention < CACHE_STALE_RETENTION {
+		retention = CACHE_STALE_RETENTION
+	}
+	return c.Lifetime - c.age(now) + retention
+}
+
+func (c *cachedResponse) Size() int64 {
+	size := int64(len(c.Body))
+	for _, chunk := range c.Chunks {
+		size += int64(len(chunk))
+	}
+	for _, h := range []http.Header{c.Header, c.Trailer} {
+		for key, values := range h {
+			size += int64(len(key))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+func (c *cachedResponse) unmarshal(req *http.Request, cc cache.Client) *http.Response {
+	header := c.header(req)
+	encoded := c.servesEncoded(req)
+	if encoded {
+		header.Set("Content-Encoding", c.codec().ContentEncoding())
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" {
+			header.Set("ETag", httplib.WeakETag(etag))
+		}
+	}
+	// Only a successful response can be validated, e.g. a cached 404 with an
+	// ETag must not be answered with 304 Not Modified
+	if c.StatusCode == 200 && !c.Negative && httplib.NotModified(req, header) {
+		return c.notModified(req, header)
+	}
+	if encoded {
+		return &http.Response{
+			Proto:            c.Proto,
+			ProtoMajor:       c.ProtoMajor,
+			ProtoMinor:       c.ProtoMinor,
+			Status:           c.Status,
+			StatusCode:       c.StatusCode,
+			Header:           header,
+			Body:             ioutil.NopCloser(c.newStoredReader(req.Context(), cc)),
+			ContentLength:    c.EncodedLength,
+			TransferEncoding: c.TransferEncoding,
+			Trailer:          c.Trailer,
+			Request:          req,
+		}
+	}
+	if c.StatusCode == 200 {
+		header.Set("Accept-Ranges", "bytes")
+		if httplib.RangeApplies(req, header) {
+			return c.partial(req, header, cc)
+		}
+	}
+	return &http.Response{
+		Proto:            c.Proto,
+		ProtoMajor:       c.ProtoMajor,
+		ProtoMinor:       c.ProtoMinor,
+		Status:           c.Status,
+		StatusCode:       c.StatusCode,
+		Header:           header,
+		Body:             c.newReader(req.Context(), cc),
+		ContentLength:    c.ContentLength,
+		TransferEncoding: c.TransferEncoding,
+		Uncompressed:     c.Uncompressed,
+		Trailer:          c.Trailer,
+		Request:          req,
+	}
+}
+
+func (c *cachedResponse) notModified(req *http.Request, header http.Header) *http.Response {
+	return &http.Response{
+		Proto:      c.Proto,
+		ProtoMajor: c.ProtoMajor,
+		ProtoMinor: c.ProtoMinor,
+		Status:     "304 Not Modified",
+		StatusCode: 304,
+		Header:     httplib.NotModifiedHeader(header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+func (c *cachedResponse) partial(req *http.Request, header http.Header, cc cache.Client) *http.Response {
+	size := c.bodySize()
+	ranges, err := httplib.ParseRange(req.Header.Get("Range"), size)
+	if err == httplib.ErrRangeNotSatisfiable {
+		header.Del("Content-Type")
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return c.rangeResponse(req, header, 416, "416 Requested Range Not Satisfiable", http.NoBody, 0)
+	}
+	if len(ranges) <= 0 {
+		return c.rangeResponse(req, header, c.StatusCode, c.Status, c.newReader(req.Context(), cc), size)
+	}
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		header.Set("Content-Range", r.ContentRange(size))
+		body := ioutil.NopCloser(c.newSectionReader(req.Context(), cc, r))
+		return c.rangeResponse(req, header, 206, "206 Partial Content", body, r.Length)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	contentType := header.Get("Content-Type")
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	go func() {
+		for _, r := range ranges {
+			partHeader := textproto.MIMEHeader{}
+			partHeader.Set("Content-Range", r.ContentRange(size))
+			if contentType != "" {
+				partHeader.Set("Content-Type", contentType)
+			}
+			part, err := mw.CreatePart(partHeader)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, c.newSectionReader(req.Context(), cc, r))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	return c.rangeResponse(req, header, 206, "206 Partial Content", pr, -1)
+}
+
+func (c *cachedResponse) rangeResponse(req *http.Request, header http.Header, statusCode int, status string, body io.ReadCloser, contentLength int64) *http.Response {
+	return &http.Response{
+		Proto:         c.Proto,
+		ProtoMajor:    c.ProtoMajor,
+		ProtoMinor:    c.ProtoMinor,
+		Status:        status,
+		StatusCode:    statusCode,
+		Header:        header,
+		Body:          body,
+		ContentLength: contentLength,
+		Request:       req,
+	}
+}
+
+func (c *cachedResponse) header(req *http.Request) http.Header {
+	header := c.Header.Clone()
+	aclOrigin := header.Get("Access-Control-Allow-Origin")
+	if aclOrigin != "" {
+		reqOrigin := req.Header.Get("Origin")
+		if reqOrigin == "" {
+			reqOrigin = "*"
+		}
+		header.Set("Access-Control-Allow-Origin", reqOrigin)
+	}
+	age := c.age(time.Now())
+	if age > 0 {
+		header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	if c.Encoding != "" {
+		httplib.AddVary(header, "Accept-Encoding")
+	}
+	return header
+}
+
+// servesEncoded reports whether the compressed body can be sent as is.
+// Range requests are answered from the decoded body instead.
+func (c *cachedResponse) servesEncoded(req *http.Request) bool {
+	codec := c.codec()
+	if codec == nil || codec.ContentEncoding() == "" || c.StatusCode != 200 {
+		return false
+	}
+	if req.Header.Get("Range") != "" {
+		return false
+	}
+	return httplib.AcceptsEncoding(req, codec.ContentEncoding())
+}
+
+func (c *cachedResponse) codec() compression.Codec {
+	codec, err := compression.Get(c.Encoding)
+	if err != nil {
+		return nil
+	}
+	return codec
+}
+
+func (c *cachedResponse) newReader(ctx context.Context, cc cache.Client) io.ReadCloser {
+	stored := c.newStoredReader(ctx, cc)
+	if c.Encoding == "" {
+		return ioutil.NopCloser(stored)
+	}
+	codec := c.codec()
+	if codec == nil {
+		return ioutil.NopCloser(&errorReader{fmt.Errorf("Unknown cache encoding %s", c.Encoding)})
+	}
+	r, err := codec.NewReader(stored)
+	if err != nil {
+		return ioutil.NopCloser(&errorReader{err})
+	}
+	return r
+}
+
+func (c *cachedResponse) newStoredReader(ctx context.Context, cc cache.Client) io.Reader {
+	if len(c.Chunks) > 0 {
+		return &chunkReader{
+			ctx:        ctx,
+			cache:      cc,
+			chunks:     c.Chunks,
+			owner:      c.owner,
+			prefetched: c.prefetched,
+		}
+	}
+	return bytes.NewReader(c.Body)
+}
+
+func (c *cachedResponse) newSectionReader(ctx context.Context, cc cache.Client, r httplib.ByteRange) io.Reader {
+	if c.Encoding != "" {
+		// Compressed bodies can't be seeked, so they are decoded from the
+		// start up to the end of the range.
+		body := c.newReader(ctx, cc)
+		if _, err := io.CopyN(ioutil.Discard, body, r.Start); err != nil {
+			return &errorReader{err}
+		}
+		return io.LimitReader(body, r.Length)
+	}
+	if len(c.Chunks) <= 0 {
+		return bytes.NewReader(c.Body[r.Start : r.Start+r.Length])
+	}
+	first := r.Start / CACHE_CHUNK_SIZE
+	last := (r.Start + r.Length - 1) / CACHE_CHUNK_SIZE
+	return io.LimitReader(&chunkReader{
+		ctx:        ctx,
+		cache:      cc,
+		chunks:     c.Chunks[first : last+1],
+		skip:       r.Start - first*CACHE_CHUNK_SIZE,
+		owner:      c.owner,
+		prefetched: c.prefetched,
+	}, r.Length)
+}
+
+func (c *cachedResponse) bodySize() int64 {
+	if len(c.Chunks) <= 0 && c.Encoding == "" {
+		return int64(len(c.Body))
+	}
+	return c.ContentLength
+}
+
+func (c *cachedResponse) storedSize() int64 {
+	if c.Encoding == "" {
+		return c.bodySize()
+	}
+	return c.EncodedLength
+}
+
+func (b *cachedBody) Size() int64 {
+	size := int64(len(b.Body))
+	for _, chunk := range b.Chunks {
+		size += int64(len(chunk))
+	}
+	return size
+}
+
+func (c *cachedChunk) Size() int64 {
+	return int64(len(c.Data))
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.reader == nil || r.reader.Len() <= 0 {
+		if len(r.fetched) <= 0 {
+			if len(r.chunks) <= 0 {
+				return 0, io.EOF
+			}
+			if err := r.fetch(); err != nil {
+				return 0, err
+			}
+		}
+		r.reader = bytes.NewReader(r.fetched[0].Data)
+		r.fetched = r.fetched[1:]
+		if r.skip > 0 {
+			r.reader.Seek(r.skip, io.SeekStart)
+			r.skip = 0
+		}
+	}
+	return r.reader.Read(p)
+}
+
+func (r *chunkReader) fetch() error {
+	keys := r.chunks
+	if len(keys) > CACHE_CHUNK_READ_AHEAD {
+		keys = keys[:CACHE_CHUNK_READ_AHEAD]
+	}
+	r.chunks = r.chunks[len(keys):]
+
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if chunk, ok := r.prefetched[key]; ok {
+			values[key] = chunk
+		}
+	}
+	if len(values) < len(keys) {
+		missing := make(map[string]interface{}, len(keys)-len(values))
+		for _, key := range keys {
+			if _, ok := values[key]; !ok {
+				missing[key] = &cachedChunk{}
+			}
+		}
+		if err := r.cache.GetMulti(r.ctx, missing); err != nil {
+			return err
+		}
+		for key, chunk := range missing {
+			values[key] = chunk
+		}
+	}
+	for _, key := range keys {
+		chunk, ok := values[key]
+		if !ok {
+			// The chunk was evicted on its own, so the entry is dropped for
+			// the next request to fetch it again.
+			if r.owner != "" {
+				r.cache.Delete(context.Background(), r.owner)
+			}
+			return fmt.Errorf("Missing cache chunk %s", key)
+		}
+		r.fetched = append(r.fetched, chunk.(*cachedChunk))
+	}
+	return nil
+}
@@ -2,16 +2,20 @@ package handlers
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	connlib "gbf-proxy/lib/conn"
+	"gbf-proxy/lib/hostrules"
 	httplib "gbf-proxy/lib/http"
 	iolib "gbf-proxy/lib/io"
 	"gbf-proxy/lib/logger"
 	"gbf-proxy/lib/logger/formatters"
+	"gbf-proxy/lib/mitm"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"strings"
 	"sync"
+	"time"
 )
 
 type GatewayHandler struct {
@@ -19,20 +23,26 @@ type GatewayHandler struct {
 	proxyHandler RequestHandler
 	webHandler   RequestHandler
 	pool         *sync.Pool
-	hostCache    map[string]bool
-	assetCache   map[string]bool
+	hostRules    *hostrules.Engine
+	authority    *mitm.Authority
 }
 
 var _ StreamForwarder = (*GatewayHandler)(nil)
 var _ RequestHandler = (*GatewayHandler)(nil)
 
-func NewGatewayHandler(version string, proxyHandler RequestHandler, webHandler RequestHandler) *GatewayHandler {
+// NewGatewayHandler creates a gateway that terminates TLS for the asset
+// hosts with certificates from the given authority, or tunnels their
+// connections as they are if it is nil.
+func NewGatewayHandler(version string, proxyHandler RequestHandler, webHandler RequestHandler, hostRules *hostrules.Engine, authority *mitm.Authority) *GatewayHandler {
+	if hostRules == nil {
+		hostRules = hostrules.MustNewEngine(nil)
+	}
 	return &GatewayHandler{
 		version:      version,
 		proxyHandler: proxyHandler,
 		webHandler:   webHandler,
-		hostCache:    make(map[string]bool),
-		assetCache:   make(map[string]bool),
+		hostRules:    hostRules,
+		authority:    authority,
 	}
 }
 
@@ -61,6 +71,10 @@ func (h *GatewayHandler) ForwardRequest(req *http.Request, ctx RequestContext, r
 		if err != nil {
 			return err
 		}
+		if req.URL.Scheme != "http" && h.authority != nil && h.AssetRequest(req) {
+			ctx.Logger.Info("Intercepting TLS connection:", reqStr)
+			return h.ForwardTLS(req, ctx, r, w)
+		}
 		if req.URL.Scheme == "http" {
 			nextReq, err := http.ReadRequest(r)
 			if err != nil {
@@ -89,6 +103,57 @@ func (h *GatewayHandler) ForwardIntercept(req *http.Request, ctx RequestContext,
 	return res.Write(w)
 }
 
+// ForwardTLS terminates TLS on a tunnel that has been established with
+// CONNECT, and intercepts the requests that are sent through it until the
+// client closes the connection.
+func (h *GatewayHandler) ForwardTLS(req *http.Request, ctx RequestContext, r io.Reader, w io.Writer) error {
+	conn := tls.Server(connlib.NewStreamConn(r, w), h.authority.Config(req.URL.Hostname()))
+	conn.SetDeadline(time.Now().Add(mitm.MITM_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		nextReq, err := http.ReadRequest(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		u := *req.URL
+		u.Scheme = "https"
+		nextReq.URL = mergeURLs(&u, nextReq.URL)
+		nextReq = sanitizeRequest(nextReq)
+		ctx.Logger.Info("Intercepting request:", requestToString(nextReq))
+		closed, err := h.forwardTLSRequest(nextReq, ctx, conn)
+		if err != nil || closed {
+			return err
+		}
+	}
+}
+
+// forwardTLSRequest reports whether the connection has to be closed after
+// the response, since its end may only be marked by closing it.
+func (h *GatewayHandler) forwardTLSRequest(req *http.Request, ctx RequestContext, w io.Writer) (bool, error) {
+	defer req.Body.Close()
+	res, err := h.HandleRequest(req, ctx)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	res.Close = res.Close || req.Close
+	if res.ContentLength < 0 && len(res.TransferEncoding) <= 0 && !res.Uncompressed {
+		res.Close = true
+	}
+	if err := res.Write(w); err != nil {
+		return true, err
+	}
+	_, err = io.Copy(ioutil.Discard, req.Body)
+	return res.Close, err
+}
+
 func (h *GatewayHandler) ForwardTunnel(req *http.Request, r io.Reader, w io.Writer) error {
 	u := req.URL
 	conn, err := connlib.CreateURLConnection(u)
@@ -117,31 +182,11 @@ func (h *GatewayHandler) HandleRequest(req *http.Request, ctx RequestContext) (*
 }
 
 func (h *GatewayHandler) RequestAllowed(req *http.Request) bool {
-	host := req.URL.Hostname()
-	if v, ok := h.hostCache[host]; ok {
-		return v
-	} else if strings.HasPrefix(host, "game") && strings.HasSuffix(host, ".granbluefantasy.jp") {
-		// do nothing
-	} else if strings.HasPrefix(host, "gbf.game") && strings.HasSuffix(host, ".mbga.jp") {
-		// do nothing
-	} else if strings.HasSuffix(host, ".mobage.jp") {
-		// do nothing
-	} else {
-		return false
-	}
-	h.hostCache[host] = true
-	return true
+	return matchHost(h.hostRules, req.URL).Allow
 }
 
 func (h *GatewayHandler) AssetRequest(req *http.Request) bool {
-	host := req.URL.Hostname()
-	if v, ok := h.assetCache[host]; ok {
-		return v
-	} else if !strings.HasPrefix(host, "game-a") && !strings.HasPrefix(host, "gbf.game-a") {
-		return false
-	}
-	h.assetCache[host] = true
-	return true
+	return matchHost(h.hostRules, req.URL).Intercept
 }
 
 func (h *GatewayHandler) CreateRequestLogger(req *http.Request) *logger.Logger {
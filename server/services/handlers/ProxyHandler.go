@@ -50,12 +50,15 @@ func outgoingRequest(req *http.Request) *http.Request {
 
 func incomingResponse(res *http.Response) *http.Response {
 	return &http.Response{
-		Proto:      res.Proto,
-		ProtoMajor: res.ProtoMajor,
-		ProtoMinor: res.ProtoMinor,
-		Status:     res.Status,
-		StatusCode: res.StatusCode,
-		Header:     res.Header,
-		Body:       res.Body,
+		Proto:         res.Proto,
+		ProtoMajor:    res.ProtoMajor,
+		ProtoMinor:    res.ProtoMinor,
+		Status:        res.Status,
+		StatusCode:    res.StatusCode,
+		Header:        res.Header,
+		Body:          res.Body,
+		ContentLength: res.ContentLength,
+		Trailer:       res.Trailer,
+		Uncompressed:  res.Uncompressed,
 	}
 }
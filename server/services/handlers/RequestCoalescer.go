@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"gbf-proxy/lib/metrics"
+	"sync"
+	"time"
+)
+
+const DEFAULT_COALESCE_TIMEOUT = 10 * time.Second
+
+type RequestCoalescer struct {
+	timeout time.Duration
+	mutex   sync.Mutex
+	flights map[string]*requestFlight
+
+	leaders   *metrics.Counter
+	followers *metrics.Counter
+	timeouts  *metrics.Counter
+	fallbacks *metrics.Counter
+}
+
+type requestFlight struct {
+	started time.Time
+	done    chan struct{}
+	ok      bool
+}
+
+func NewRequestCoalescer(timeout time.Duration) *RequestCoalescer {
+	if timeout <= 0 {
+		timeout = DEFAULT_COALESCE_TIMEOUT
+	}
+	registry := metrics.DefaultRegistry
+	return &RequestCoalescer{
+		timeout:   timeout,
+		flights:   make(map[string]*requestFlight),
+		leaders:   registry.Counter("coalesce.leaders"),
+		followers: registry.Counter("coalesce.followers"),
+		timeouts:  registry.Counter("coalesce.timeouts"),
+		fallbacks: registry.Counter("coalesce.fallbacks"),
+	}
+}
+
+func (c *RequestCoalescer) Join(key string) (*requestFlight, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f, ok := c.flights[key]
+	// A leader that has been running for longer than the timeout is
+	// presumed stuck, so the next request takes over the flight.
+	if ok && time.Since(f.started) < c.timeout {
+		c.followers.Inc()
+		return f, false
+	}
+	f = &requestFlight{
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	c.flights[key] = f
+	c.leaders.Inc()
+	return f, true
+}
+
+func (c *RequestCoalescer) Wait(f *requestFlight) bool {
+	timer := time.NewTimer(c.timeout - time.Since(f.started))
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		if !f.ok {
+			c.fallbacks.Inc()
+		}
+		return f.ok
+	case <-timer.C:
+		c.timeouts.Inc()
+		return false
+	}
+}
+
+func (c *RequestCoalescer) Finish(key string, f *requestFlight, ok bool) {
+	c.mutex.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mutex.Unlock()
+	f.ok = ok
+	close(f.done)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"gbf-proxy/lib/hostrules"
 	"net/http"
 	"net/url"
 )
@@ -19,6 +20,19 @@ func sanitizeRequest(req *http.Request) *http.Request {
 	return req
 }
 
+func matchHost(rules *hostrules.Engine, u *url.URL) hostrules.Decision {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return rules.Match(u.Hostname(), port)
+}
+
 func sanitizeURL(u *url.URL) *url.URL {
 	if u.Path == "" {
 		u.Path = "/"